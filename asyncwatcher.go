@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Async action phases an asyncWatchEvent can report. The cloud66 API
+// doesn't expose fine-grained phase transitions for a running async
+// action, so "building" is emitted as a heartbeat for as long as the
+// action is outstanding; "queued" and the terminal phase are the only ones
+// known for certain.
+const (
+	asyncPhaseQueued    = "queued"
+	asyncPhaseBuilding  = "building"
+	asyncPhaseDeploying = "deploying"
+	asyncPhaseDone      = "done"
+	asyncPhaseError     = "error"
+)
+
+// asyncWatchEvent is one line of --watch's newline-delimited JSON output,
+// meant to be piped into a CI dashboard or jq rather than read by a human.
+type asyncWatchEvent struct {
+	TS       string `json:"ts"`
+	Phase    string `json:"phase"`
+	Message  string `json:"message,omitempty"`
+	Server   string `json:"server,omitempty"`
+	Progress int    `json:"progress,omitempty"`
+}
+
+func newAsyncWatchEvent(phase string, message string) asyncWatchEvent {
+	return asyncWatchEvent{
+		TS:      time.Now().UTC().Format(time.RFC3339Nano),
+		Phase:   phase,
+		Message: message,
+	}
+}
+
+// watchStackAsyncAction polls stackUid's asyncId the same way
+// client.WaitStackAsyncAction does, but reports progress as a stream of
+// events instead of blocking silently until completion: a "queued" event
+// right away, a heartbeatPhase event every heartbeat while the action is
+// still outstanding, and a final "done" or "error" event carrying the
+// result. The returned channel is closed once the final event has been
+// sent.
+func watchStackAsyncAction(asyncId int, stackUid string, heartbeatPhase string, heartbeat time.Duration, timeout time.Duration) <-chan asyncWatchEvent {
+	events := make(chan asyncWatchEvent, 1)
+
+	go func() {
+		defer close(events)
+		events <- newAsyncWatchEvent(asyncPhaseQueued, "")
+
+		type waitResult struct {
+			message string
+			err     error
+		}
+		done := make(chan waitResult, 1)
+		go func() {
+			genericRes, err := client.WaitStackAsyncAction(asyncId, stackUid, 3*time.Second, timeout, false)
+			if err != nil {
+				done <- waitResult{err: err}
+				return
+			}
+			done <- waitResult{message: genericRes.Message}
+		}()
+
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case result := <-done:
+				if result.err != nil {
+					events <- newAsyncWatchEvent(asyncPhaseError, result.err.Error())
+				} else {
+					events <- newAsyncWatchEvent(asyncPhaseDone, result.message)
+				}
+				return
+			case <-ticker.C:
+				events <- newAsyncWatchEvent(heartbeatPhase, "")
+			}
+		}
+	}()
+
+	return events
+}
+
+// printAsyncWatchEvents prints each event on events as one NDJSON line,
+// and reports whether the stream ended on an error.
+func printAsyncWatchEvents(events <-chan asyncWatchEvent) bool {
+	failed := false
+	for event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			fmt.Printf(`{"phase":"error","message":%q}`+"\n", err.Error())
+			failed = true
+			continue
+		}
+		fmt.Println(string(data))
+		if event.Phase == asyncPhaseError {
+			failed = true
+		}
+	}
+	return failed
+}
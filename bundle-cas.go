@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const casBlobsDirName = "blobs"
+const casPackIndexFilename = "packindex.json"
+
+// casPackEntry records the content-addressed blob backing a single file in
+// a bundle, keyed by its path relative to the bundle directory.
+type casPackEntry struct {
+	Path string `json:"path"`
+	Blob string `json:"blob"`
+}
+
+// casPackIndex is the packindex.json sidecar written alongside manifest.json:
+// it maps every stencil/policy/transformation/workflow file in the bundle to
+// the sha256 of its content, and carries a root digest covering all of them
+// so the whole tree's integrity can be checked with a single comparison.
+type casPackIndex struct {
+	RootDigest string         `json:"root_digest"`
+	Entries    []casPackEntry `json:"entries"`
+}
+
+// writeContentAddressedIndex hashes every file under the given bundle-relative
+// directories, stores one copy of each distinct body under dir/blobs/<sha256>,
+// and writes a packindex.json recording the path-to-blob mapping plus a root
+// digest. Identical bodies - for example two stencils sharing a base
+// template - collapse to a single blob.
+func writeContentAddressedIndex(dir string, relDirs []string) error {
+	blobsDir := filepath.Join(dir, casBlobsDirName)
+	if err := os.MkdirAll(blobsDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	var entries []casPackEntry
+	for _, relDir := range relDirs {
+		absDir := filepath.Join(dir, relDir)
+		files, err := ioutil.ReadDir(absDir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+
+			body, err := ioutil.ReadFile(filepath.Join(absDir, file.Name()))
+			if err != nil {
+				return err
+			}
+
+			blob := fmt.Sprintf("%x", sha256.Sum256(body))
+			blobPath := filepath.Join(blobsDir, blob)
+			if _, err := os.Stat(blobPath); os.IsNotExist(err) {
+				if err := ioutil.WriteFile(blobPath, body, 0600); err != nil {
+					return err
+				}
+			}
+
+			entries = append(entries, casPackEntry{
+				Path: filepath.Join(relDir, file.Name()),
+				Blob: blob,
+			})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	index := casPackIndex{
+		RootDigest: computeRootDigest(entries),
+		Entries:    entries,
+	}
+
+	buf, err := json.MarshalIndent(index, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, casPackIndexFilename), buf, 0600)
+}
+
+// computeRootDigest hashes the sorted "path:blob" pairs of a pack index, so
+// any change to a file's content, its path, or the set of files changes the
+// result.
+func computeRootDigest(entries []casPackEntry) string {
+	h := sha256.New()
+	for _, entry := range entries {
+		fmt.Fprintf(h, "%s:%s\n", entry.Path, entry.Blob)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// loadPackIndex reads packindex.json from a bundle directory. A bundle
+// created before this index existed simply has no such file.
+func loadPackIndex(dir string) (*casPackIndex, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, casPackIndexFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	var index casPackIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+
+	return &index, nil
+}
+
+// verifyPackIndex re-hashes every blob referenced by index, confirms it
+// matches its key, then recomputes the root digest and compares it against
+// the one recorded in the index.
+func verifyPackIndex(dir string, index *casPackIndex) error {
+	for _, entry := range index.Entries {
+		body, err := ioutil.ReadFile(filepath.Join(dir, casBlobsDirName, entry.Blob))
+		if err != nil {
+			return fmt.Errorf("blob %s for %s is missing: %s", entry.Blob, entry.Path, err.Error())
+		}
+
+		actual := fmt.Sprintf("%x", sha256.Sum256(body))
+		if actual != entry.Blob {
+			return fmt.Errorf("blob for %s is corrupt: expected %s, got %s", entry.Path, entry.Blob, actual)
+		}
+	}
+
+	if actual := computeRootDigest(index.Entries); actual != index.RootDigest {
+		return fmt.Errorf("root digest mismatch: expected %s, got %s", index.RootDigest, actual)
+	}
+
+	return nil
+}
+
+// verifyBundleIntegrity checks a bundle's content-addressed blobs against
+// its packindex.json, if present. Bundles created before packindex.json
+// existed are treated as trusted and skipped, so older bundles still upload.
+func verifyBundleIntegrity(bundlePath string) error {
+	index, err := loadPackIndex(bundlePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	fmt.Println("Verifying bundle content integrity...")
+	if err := verifyPackIndex(bundlePath, index); err != nil {
+		return fmt.Errorf("bundle integrity check failed: %s", err.Error())
+	}
+	fmt.Println("Bundle content integrity verified")
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"gopkg.in/go-yaml/yaml.v2"
+)
+
+// driftServiceState is one service's desired or live image/env-var state,
+// keyed by service name in driftState.Services.
+type driftServiceState struct {
+	Image   string            `yaml:"image,omitempty"`
+	EnvVars map[string]string `yaml:"env_vars,omitempty"`
+}
+
+// driftState is a stack's state along the dimensions --detect-drift
+// compares: per-service image/env vars, and stack-level env vars. It's used
+// for both the desired side (a deployment profile or --desired manifest)
+// and the live side (what's actually fetched off the running stack), so the
+// two can be diffed resource-kind by resource-kind.
+type driftState struct {
+	Services map[string]driftServiceState `yaml:"services,omitempty"`
+	EnvVars  map[string]string            `yaml:"env_vars,omitempty"`
+}
+
+// loadDesiredDriftState builds the desired side of a drift check: an
+// explicit --desired manifest takes precedence, otherwise the named
+// deployment-profile's configuration is fetched from the API.
+func loadDesiredDriftState(stackUid string, deploymentProfile string, desiredManifestPath string) (*driftState, error) {
+	if desiredManifestPath != "" {
+		data, err := ioutil.ReadFile(desiredManifestPath)
+		if err != nil {
+			return nil, err
+		}
+		var state driftState
+		if err := yaml.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", desiredManifestPath, err)
+		}
+		return &state, nil
+	}
+
+	if deploymentProfile == "" {
+		return nil, fmt.Errorf("drift detection needs either --desired or --deployment-profile")
+	}
+
+	profile, err := client.StackDeploymentProfile(stackUid, deploymentProfile)
+	if err != nil {
+		return nil, fmt.Errorf("fetching deployment profile %q: %w", deploymentProfile, err)
+	}
+
+	state := &driftState{
+		Services: make(map[string]driftServiceState, len(profile.Services)),
+		EnvVars:  profile.EnvVars,
+	}
+	for _, svc := range profile.Services {
+		state.Services[svc.Name] = driftServiceState{Image: svc.Image, EnvVars: svc.EnvVars}
+	}
+	return state, nil
+}
+
+// fetchLiveDriftState fetches a stack's current running service/image state
+// and env vars, the live side of a drift check.
+func fetchLiveDriftState(stackUid string) (*driftState, error) {
+	services, err := client.StackServices(stackUid)
+	if err != nil {
+		return nil, fmt.Errorf("fetching live service state: %w", err)
+	}
+
+	envVars, err := client.StackEnvVars(stackUid)
+	if err != nil {
+		return nil, fmt.Errorf("fetching live env vars: %w", err)
+	}
+
+	state := &driftState{
+		Services: make(map[string]driftServiceState, len(services)),
+		EnvVars:  make(map[string]string, len(envVars)),
+	}
+	for _, svc := range services {
+		state.Services[svc.Name] = driftServiceState{Image: svc.Image, EnvVars: svc.EnvVars}
+	}
+	for _, envVar := range envVars {
+		state.EnvVars[envVar.Key] = envVarStringValue(envVar)
+	}
+
+	return state, nil
+}
+
+// driftFinding is one difference diffDriftStates found between desired and
+// live, grouped by resource kind ("service", "service-env" or "env-var") the same way a
+// CD agent's drift detector reports per-resource-kind diffs.
+type driftFinding struct {
+	Kind    string
+	Name    string
+	Field   string
+	Desired string
+	Live    string
+}
+
+func (f driftFinding) String() string {
+	if f.Field == "" {
+		return fmt.Sprintf("[%s] %s: desired=%q live=%q", f.Kind, f.Name, f.Desired, f.Live)
+	}
+	return fmt.Sprintf("[%s] %s.%s: desired=%q live=%q", f.Kind, f.Name, f.Field, f.Desired, f.Live)
+}
+
+// diffDriftStates compares desired against live, one resource kind at a
+// time: services (by name, then image and each env var), then stack-level
+// env vars. A service or env var present on only one side is reported with
+// the missing side left blank.
+func diffDriftStates(desired *driftState, live *driftState) []driftFinding {
+	var findings []driftFinding
+
+	serviceNames := make(map[string]bool)
+	for name := range desired.Services {
+		serviceNames[name] = true
+	}
+	for name := range live.Services {
+		serviceNames[name] = true
+	}
+	for _, name := range sortedKeys(serviceNames) {
+		d, dok := desired.Services[name]
+		l, lok := live.Services[name]
+		if !dok {
+			findings = append(findings, driftFinding{Kind: "service", Name: name, Live: l.Image})
+			continue
+		}
+		if !lok {
+			findings = append(findings, driftFinding{Kind: "service", Name: name, Desired: d.Image})
+			continue
+		}
+		if d.Image != l.Image {
+			findings = append(findings, driftFinding{Kind: "service", Name: name, Field: "image", Desired: d.Image, Live: l.Image})
+		}
+		findings = append(findings, diffEnvVarMaps("service-env", name, d.EnvVars, l.EnvVars)...)
+	}
+
+	findings = append(findings, diffEnvVarMaps("env-var", "", desired.EnvVars, live.EnvVars)...)
+
+	return findings
+}
+
+// diffEnvVarMaps compares two env var maps, emitting one finding per key
+// that's missing from either side or whose value differs.
+func diffEnvVarMaps(kind string, scope string, desired map[string]string, live map[string]string) []driftFinding {
+	var findings []driftFinding
+
+	keys := make(map[string]bool)
+	for key := range desired {
+		keys[key] = true
+	}
+	for key := range live {
+		keys[key] = true
+	}
+
+	for _, key := range sortedKeys(keys) {
+		d, dok := desired[key]
+		l, lok := live[key]
+		if d == l && dok == lok {
+			continue
+		}
+		name := key
+		if scope != "" {
+			name = scope + "." + key
+		}
+		findings = append(findings, driftFinding{Kind: kind, Name: name, Desired: d, Live: l})
+	}
+
+	return findings
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
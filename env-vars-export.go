@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cloud66-oss/cloud66"
+
+	"github.com/cloud66/cli"
+	"gopkg.in/go-yaml/yaml.v2"
+)
+
+// Env var export formats, selected with --format.
+const (
+	envVarExportFormatDotenv = "dotenv"
+	envVarExportFormatJSON   = "json"
+	envVarExportFormatYAML   = "yaml"
+	envVarExportFormatShell  = "shell"
+	envVarExportFormatTF     = "tf"
+)
+
+// parseEnvVarExportFormat validates --format, defaulting an empty value to
+// envVarExportFormatDotenv.
+func parseEnvVarExportFormat(format string) (string, error) {
+	switch format {
+	case "":
+		return envVarExportFormatDotenv, nil
+	case envVarExportFormatDotenv, envVarExportFormatJSON, envVarExportFormatYAML, envVarExportFormatShell, envVarExportFormatTF:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown --format %q. Supported values are dotenv, json, yaml, shell, tf", format)
+	}
+}
+
+func runEnvVarsExport(c *cli.Context) {
+	format, err := parseEnvVarExportFormat(c.String("format"))
+	must(err)
+
+	includeReadonly := c.Bool("include-readonly")
+	includeHistory := c.Bool("history")
+
+	stack := mustStack(c)
+	envVars, err := client.StackEnvVars(stack.Uid)
+	must(err)
+
+	sort.Sort(envVarsByName(envVars))
+
+	var filtered []cloud66.StackEnvVar
+	for _, envVar := range envVars {
+		if envVar.Readonly && !includeReadonly {
+			continue
+		}
+		filtered = append(filtered, envVar)
+	}
+
+	output, err := formatEnvVarsExport(filtered, format, includeHistory)
+	must(err)
+
+	if file := c.String("file"); file != "" {
+		must(ioutil.WriteFile(file, output, 0600))
+	} else {
+		_, err = os.Stdout.Write(output)
+		must(err)
+	}
+}
+
+func formatEnvVarsExport(envVars []cloud66.StackEnvVar, format string, includeHistory bool) ([]byte, error) {
+	switch format {
+	case envVarExportFormatDotenv:
+		return formatEnvVarsDotenv(envVars, includeHistory), nil
+	case envVarExportFormatShell:
+		return formatEnvVarsShell(envVars, includeHistory), nil
+	case envVarExportFormatTF:
+		return formatEnvVarsTerraform(envVars), nil
+	case envVarExportFormatJSON:
+		return json.MarshalIndent(envVarsExportMap(envVars), "", "    ")
+	case envVarExportFormatYAML:
+		return yaml.Marshal(envVarsExportMap(envVars))
+	default:
+		return nil, fmt.Errorf("unknown --format %q. Supported values are dotenv, json, yaml, shell, tf", format)
+	}
+}
+
+func envVarsExportMap(envVars []cloud66.StackEnvVar) map[string]string {
+	m := make(map[string]string, len(envVars))
+	for _, envVar := range envVars {
+		m[envVar.Key] = envVarStringValue(envVar)
+	}
+	return m
+}
+
+// envVarStringValue renders a StackEnvVar's Value (an interface{}, since
+// the API can hand back non-string scalars) as a string.
+func envVarStringValue(envVar cloud66.StackEnvVar) string {
+	if s, ok := envVar.Value.(string); ok {
+		return s
+	}
+	return fmt.Sprintf("%v", envVar.Value)
+}
+
+func formatEnvVarsDotenv(envVars []cloud66.StackEnvVar, includeHistory bool) []byte {
+	var b bytes.Buffer
+	for _, envVar := range envVars {
+		fmt.Fprintf(&b, "%s=%s\n", envVar.Key, quoteEnvValueIfNeeded(envVarStringValue(envVar)))
+		writeEnvVarHistoryComments(&b, envVar, includeHistory)
+	}
+	return b.Bytes()
+}
+
+func formatEnvVarsShell(envVars []cloud66.StackEnvVar, includeHistory bool) []byte {
+	var b bytes.Buffer
+	for _, envVar := range envVars {
+		fmt.Fprintf(&b, "export %s=%s\n", envVar.Key, quoteEnvValueIfNeeded(envVarStringValue(envVar)))
+		writeEnvVarHistoryComments(&b, envVar, includeHistory)
+	}
+	return b.Bytes()
+}
+
+func formatEnvVarsTerraform(envVars []cloud66.StackEnvVar) []byte {
+	var b bytes.Buffer
+	for _, envVar := range envVars {
+		fmt.Fprintf(&b, "%s = %q\n", envVar.Key, envVarStringValue(envVar))
+	}
+	return b.Bytes()
+}
+
+func writeEnvVarHistoryComments(b *bytes.Buffer, envVar cloud66.StackEnvVar, includeHistory bool) {
+	if !includeHistory {
+		return
+	}
+	for _, h := range envVar.History {
+		fmt.Fprintf(b, "# %s was %v at %v\n", envVar.Key, h.Value, h.UpdatedAt)
+	}
+}
+
+// quoteEnvValueIfNeeded wraps value in double quotes, with Go escaping
+// (strconv.Quote), if it's empty or contains whitespace (including line
+// breaks), a quote, '#' or '$'. parseEnvFileLine undoes that quoting, so
+// the value reads back unchanged.
+func quoteEnvValueIfNeeded(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\r\n\"'#$") {
+		return strconv.Quote(value)
+	}
+	return value
+}
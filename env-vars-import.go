@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloud66-oss/cloud66"
+
+	"github.com/cloud66/cli"
+	"gopkg.in/go-yaml/yaml.v2"
+)
+
+// parseEnvVarImportFormat validates --format for "env-vars import", falling
+// back to the file's extension (and then to dotenv) when it's not given.
+func parseEnvVarImportFormat(format string, file string) (string, error) {
+	if format != "" {
+		switch format {
+		case envVarExportFormatDotenv, envVarExportFormatJSON, envVarExportFormatYAML:
+			return format, nil
+		default:
+			return "", fmt.Errorf("unknown --format %q. Supported values are dotenv, json, yaml", format)
+		}
+	}
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		return envVarExportFormatJSON, nil
+	case ".yml", ".yaml":
+		return envVarExportFormatYAML, nil
+	default:
+		return envVarExportFormatDotenv, nil
+	}
+}
+
+// parseEnvVarsImportFile reads path as a KEY=VALUE map in the given format.
+func parseEnvVarsImportFile(path string, format string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := make(map[string]string)
+	switch format {
+	case envVarExportFormatJSON:
+		if err := json.Unmarshal(data, &vars); err != nil {
+			return nil, err
+		}
+	case envVarExportFormatYAML:
+		if err := yaml.Unmarshal(data, &vars); err != nil {
+			return nil, err
+		}
+	case envVarExportFormatDotenv:
+		for _, line := range strings.Split(string(data), "\n") {
+			if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			if key, value, ok := parseEnvFileLine(line); ok {
+				vars[key] = value
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown env file format %q", format)
+	}
+
+	return vars, nil
+}
+
+// Actions diffEnvVarsImport can assign to an imported key.
+const (
+	envVarImportAdd       = "add"
+	envVarImportUpdate    = "update"
+	envVarImportDelete    = "delete"
+	envVarImportUnchanged = "unchanged"
+)
+
+// envVarImportChange is one key "env-vars import" diffed local against
+// remote, and what it decided to do about it.
+type envVarImportChange struct {
+	Key      string
+	Action   string
+	OldValue string
+	NewValue string
+}
+
+// diffEnvVarsImport compares local (the file being imported) against the
+// stack's current env vars in remote, classifying every key as an add,
+// update, unchanged, or - only when prune is set - a delete. Readonly
+// remote vars are skipped entirely since they can't be changed.
+func diffEnvVarsImport(local map[string]string, remote []cloud66.StackEnvVar, prune bool) []envVarImportChange {
+	remoteValues := make(map[string]string, len(remote))
+	remoteReadonly := make(map[string]bool, len(remote))
+	for _, envVar := range remote {
+		remoteValues[envVar.Key] = envVarStringValue(envVar)
+		remoteReadonly[envVar.Key] = envVar.Readonly
+	}
+
+	var changes []envVarImportChange
+
+	keys := make([]string, 0, len(local))
+	for key := range local {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if remoteReadonly[key] {
+			continue
+		}
+		oldValue, existing := remoteValues[key]
+		switch {
+		case !existing:
+			changes = append(changes, envVarImportChange{Key: key, Action: envVarImportAdd, NewValue: local[key]})
+		case oldValue != local[key]:
+			changes = append(changes, envVarImportChange{Key: key, Action: envVarImportUpdate, OldValue: oldValue, NewValue: local[key]})
+		default:
+			changes = append(changes, envVarImportChange{Key: key, Action: envVarImportUnchanged, OldValue: oldValue, NewValue: local[key]})
+		}
+	}
+
+	if prune {
+		remoteKeys := make([]string, 0, len(remote))
+		for _, envVar := range remote {
+			remoteKeys = append(remoteKeys, envVar.Key)
+		}
+		sort.Strings(remoteKeys)
+		for _, key := range remoteKeys {
+			if remoteReadonly[key] {
+				continue
+			}
+			if _, ok := local[key]; !ok {
+				changes = append(changes, envVarImportChange{Key: key, Action: envVarImportDelete, OldValue: remoteValues[key]})
+			}
+		}
+	}
+
+	return changes
+}
+
+func printEnvVarImportPlan(changes []envVarImportChange) {
+	for _, change := range changes {
+		switch change.Action {
+		case envVarImportAdd:
+			fmt.Printf("[add] %s=%s\n", change.Key, change.NewValue)
+		case envVarImportUpdate:
+			fmt.Printf("[update] %s: %s -> %s\n", change.Key, change.OldValue, change.NewValue)
+		case envVarImportDelete:
+			fmt.Printf("[delete] %s\n", change.Key)
+		case envVarImportUnchanged:
+			fmt.Printf("[unchanged] %s\n", change.Key)
+		}
+	}
+}
+
+func runEnvVarsImport(c *cli.Context) {
+	file := c.String("file")
+	if file == "" {
+		printFatal("No file provided. Please use --file to specify the env file to import")
+	}
+
+	format, err := parseEnvVarImportFormat(c.String("format"), file)
+	must(err)
+
+	flagApplyStrategy := c.String("apply-strategy")
+	if flagApplyStrategy == "" {
+		flagApplyStrategy = "immediately"
+	} else if flagApplyStrategy != "immediately" && flagApplyStrategy != "deployment" {
+		printFatal("The selected apply-strategy is not valid. Please choose from \"immediately\" or \"deployment\"")
+	}
+
+	prune := c.Bool("prune")
+	dryRun := c.Bool("dry-run")
+
+	local, err := parseEnvVarsImportFile(file, format)
+	must(err)
+
+	stack := mustStack(c)
+	remote, err := client.StackEnvVars(stack.Uid)
+	must(err)
+
+	changes := diffEnvVarsImport(local, remote, prune)
+	printEnvVarImportPlan(changes)
+
+	if dryRun {
+		return
+	}
+
+	existingByKey := make(map[string]bool, len(remote))
+	for _, envVar := range remote {
+		existingByKey[envVar.Key] = true
+	}
+
+	var applicable []envVarImportChange
+	for _, change := range changes {
+		if change.Action == envVarImportAdd || change.Action == envVarImportUpdate {
+			applicable = append(applicable, change)
+		}
+	}
+
+	if len(applicable) > 0 {
+		fmt.Println("Applying environment variable changes...")
+		errs := make([]error, len(applicable))
+		newUploadSemaphore(4).run(len(applicable), func(i int) {
+			change := applicable[i]
+			asyncId, err := startEnvVarSet(stack.Uid, change.Key, change.NewValue, existingByKey[change.Key], flagApplyStrategy)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			_, errs[i] = endEnvVarSet(*asyncId, stack.Uid)
+		})
+		for i, err := range errs {
+			if err != nil {
+				printFatal("failed to apply %s: %s", applicable[i].Key, err.Error())
+			}
+		}
+	}
+
+	if prune {
+		for _, change := range changes {
+			if change.Action != envVarImportDelete {
+				continue
+			}
+			if err := deleteEnvVar(stack.Uid, change.Key); err != nil {
+				printFatal("failed to delete %s: %s", change.Key, err.Error())
+			}
+		}
+	}
+
+	fmt.Println("Done.")
+}
+
+func deleteEnvVar(stackUid string, key string) error {
+	asyncRes, err := client.StackEnvVarDelete(stackUid, key)
+	if err != nil {
+		return err
+	}
+	_, err = client.WaitStackAsyncAction(asyncRes.Id, stackUid, 3*time.Second, 20*time.Minute, true)
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/cloud66-oss/cloud66"
+
+	"github.com/cloud66/cli"
+)
+
+// envVarTemplateData is what a --from-file template can refer to.
+type envVarTemplateData struct {
+	StackName   string
+	Environment string
+	Framework   string
+}
+
+func newEnvVarTemplateData(stack *cloud66.Stack) envVarTemplateData {
+	return envVarTemplateData{
+		StackName:   stack.Name,
+		Environment: stack.Environment,
+		Framework:   stack.Framework,
+	}
+}
+
+// renderEnvVarTemplateFile executes the Go text/template at path against
+// stack's metadata and returns its output.
+func renderEnvVarTemplateFile(path string, stack *cloud66.Stack) (string, error) {
+	tplSource, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	tpl, err := template.New(path).Parse(string(tplSource))
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	if err := tpl.Execute(&out, newEnvVarTemplateData(stack)); err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
+
+// runEnvVarsRender renders a --from-file template against the stack's
+// metadata, resolves every line's value (secret:// providers, then
+// ${OTHER_VAR} interpolation against the stack's current env vars), and
+// prints the result as dotenv output - ready to pipe into "env-vars
+// import" or inspect before applying anything.
+func runEnvVarsRender(c *cli.Context) {
+	templateFile := c.String("from-file")
+	if templateFile == "" {
+		printFatal("No template provided. Please use --from-file to specify a template file")
+	}
+
+	stack := mustStack(c)
+
+	rendered, err := renderEnvVarTemplateFile(templateFile, stack)
+	must(err)
+
+	remote, err := client.StackEnvVars(stack.Uid)
+	must(err)
+	existing := make(map[string]string, len(remote))
+	for _, envVar := range remote {
+		existing[envVar.Key] = envVarStringValue(envVar)
+	}
+
+	var out bytes.Buffer
+	for _, line := range strings.Split(rendered, "\n") {
+		if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		key, value, ok := parseEnvFileLine(line)
+		if !ok {
+			continue
+		}
+
+		resolved, err := resolveEnvVarValue(value, existing)
+		must(err)
+
+		fmt.Fprintf(&out, "%s=%s\n", key, quoteEnvValueIfNeeded(resolved))
+	}
+
+	if file := c.String("file"); file != "" {
+		must(ioutil.WriteFile(file, out.Bytes(), 0600))
+	} else {
+		_, err = os.Stdout.Write(out.Bytes())
+		must(err)
+	}
+}
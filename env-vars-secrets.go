@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// secretProvider resolves a provider-specific reference to the secret
+// value it names. Keeping secrets out of the value a user types - shell
+// history, CI logs - is the whole point, so providers only ever receive a
+// reference, never a value to echo back.
+type secretProvider interface {
+	Resolve(ref string) (string, error)
+}
+
+// envSecretProvider reads the secret out of the CLI's own environment.
+type envSecretProvider struct{}
+
+func (envSecretProvider) Resolve(ref string) (string, error) {
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %q is not set", ref)
+	}
+	return value, nil
+}
+
+// fileSecretProvider reads the secret from a local file, trimming a single
+// trailing newline the way most secret-mount conventions (Docker secrets,
+// Kubernetes projected volumes) write them.
+type fileSecretProvider struct{}
+
+func (fileSecretProvider) Resolve(ref string) (string, error) {
+	data, err := ioutil.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+// execSecretProvider runs a shell command and takes its trimmed stdout as
+// the secret - for shelling out to a password manager's CLI, for example.
+type execSecretProvider struct{}
+
+func (execSecretProvider) Resolve(ref string) (string, error) {
+	fields := strings.Fields(ref)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty exec secret reference")
+	}
+
+	cmd := exec.Command(fields[0], fields[1:]...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = err.Error()
+		}
+		return "", fmt.Errorf("exec secret %q failed: %s", ref, message)
+	}
+
+	return strings.TrimSuffix(stdout.String(), "\n"), nil
+}
+
+// secretProviders is the registry --render and "env-vars render" dispatch
+// a secret://<provider>/<ref> value to. New backends register here.
+var secretProviders = map[string]secretProvider{
+	"env":  envSecretProvider{},
+	"file": fileSecretProvider{},
+	"exec": execSecretProvider{},
+}
+
+const secretValuePrefix = "secret://"
+
+// resolveSecretValue resolves a "secret://<provider>/<ref>" value through
+// the named provider. Values without the prefix are returned unchanged.
+func resolveSecretValue(value string) (string, error) {
+	if !strings.HasPrefix(value, secretValuePrefix) {
+		return value, nil
+	}
+
+	rest := strings.TrimPrefix(value, secretValuePrefix)
+	providerName, ref, found := strings.Cut(rest, "/")
+	if !found {
+		return "", fmt.Errorf("invalid secret reference %q: expected \"secret://<provider>/<ref>\"", value)
+	}
+
+	provider, ok := secretProviders[providerName]
+	if !ok {
+		names := make([]string, 0, len(secretProviders))
+		for name := range secretProviders {
+			names = append(names, name)
+		}
+		return "", fmt.Errorf("unknown secret provider %q. Supported values are %s", providerName, strings.Join(names, ", "))
+	}
+
+	return provider.Resolve(ref)
+}
+
+// envVarRefPattern matches a "${OTHER_VAR}" style reference.
+var envVarRefPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// interpolateEnvVarRefs replaces every "${OTHER_VAR}" in value with its
+// value from existing, the stack's current environment variables. A
+// reference to a key that doesn't exist is left untouched, the same way
+// an unset shell variable expands to an empty string rather than erroring -
+// except here we keep the literal text, so a typo is visible in the result
+// instead of silently vanishing.
+func interpolateEnvVarRefs(value string, existing map[string]string) string {
+	return envVarRefPattern.ReplaceAllStringFunc(value, func(match string) string {
+		key := envVarRefPattern.FindStringSubmatch(match)[1]
+		if resolved, ok := existing[key]; ok {
+			return resolved
+		}
+		return match
+	})
+}
+
+// resolveEnvVarValue is what --render applies to a value before it's
+// submitted: secret:// references are resolved first (so a secret's own
+// value can itself still contain ${OTHER_VAR} placeholders), then
+// ${OTHER_VAR} placeholders are interpolated against existing.
+func resolveEnvVarValue(value string, existing map[string]string) (string, error) {
+	resolved, err := resolveSecretValue(value)
+	if err != nil {
+		return "", err
+	}
+	return interpolateEnvVarRefs(resolved, existing), nil
+}
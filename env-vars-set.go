@@ -41,6 +41,15 @@ func runEnvVarsSet(c *cli.Context) {
 	envVars, err := client.StackEnvVars(stack.Uid)
 	must(err)
 
+	if c.Bool("render") {
+		existingValues := make(map[string]string, len(envVars))
+		for _, envVar := range envVars {
+			existingValues[envVar.Key] = envVarStringValue(envVar)
+		}
+		value, err = resolveEnvVarValue(value, existingValues)
+		must(err)
+	}
+
 	existing := false
 	for _, i := range envVars {
 		if i.Key == key {
@@ -52,16 +61,24 @@ func runEnvVarsSet(c *cli.Context) {
 		}
 	}
 
+	asyncId, err := startEnvVarSet(stack.Uid, key, value, existing, flagApplyStrategy)
+	if err != nil {
+		printFatal(err.Error())
+	}
+
+	if c.Bool("watch") {
+		if printAsyncWatchEvents(watchStackAsyncAction(*asyncId, stack.Uid, asyncPhaseBuilding, 3*time.Second, 20*time.Minute)) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	if flagApplyStrategy == "immediately" {
 		fmt.Println("Please wait while your changes are applied immediately...")
 	} else {
 		fmt.Println("Your changes will be applied during your next deployment!")
 	}
 
-	asyncId, err := startEnvVarSet(stack.Uid, key, value, existing, flagApplyStrategy)
-	if err != nil {
-		printFatal(err.Error())
-	}
 	genericRes, err := endEnvVarSet(*asyncId, stack.Uid)
 	if err != nil {
 		printFatal(err.Error())
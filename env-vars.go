@@ -73,22 +73,130 @@ STACK_BASE      	/abc/def
 					Name:  "apply-strategy",
 					Usage: "apply changes immediately, or during next deployment",
 				},
+				cli.BoolFlag{
+					Name:  "render",
+					Usage: "[OPTIONAL] resolve secret:// references and ${OTHER_VAR} interpolation in the value before setting it",
+				},
+				cli.BoolFlag{
+					Name:  "watch",
+					Usage: "[OPTIONAL] stream newline-delimited JSON progress events instead of the human-readable output",
+				},
 			},
 			Description: `This sets and applies the value of an environment variable on a stack.
 This work happens in the background, therefore this command will return immediately after the operation has started.
 
 You can use the apply-strategy option to specify "immediately" or "deployment". This will determine how Cloud 66 will apply
-these environment variables to your servers. The default is "immediately" (for backwards compatibility) 
-			
+these environment variables to your servers. The default is "immediately" (for backwards compatibility)
+
 Warning! Applying environment variable changes "immediately" will result in all your environment variables
 being sent to your servers immediately, and running processes being restarted. NOTE: If you have load balancer, we will
 automatically remove servers from the load balancer before applying changes.
-			
+
+With --render, the value is resolved before it's sent: a "secret://<provider>/<ref>" value is
+fetched from the named provider (env, file or exec - see "env-vars render" for details), and any
+"${OTHER_VAR}" in the result is interpolated against the stack's current environment variables.
+
 Examples:
 $ cx env-vars set -s mystack FIRST_VAR=123
 $ cx env-vars set -s mystack SECOND_ONE='this value has a space in it'
-$ cx env-vars set -s mystack --apply-strategy=immediately EXAMPLE1='this will be applied on immediately' 
+$ cx env-vars set -s mystack --apply-strategy=immediately EXAMPLE1='this will be applied on immediately'
 $ cx env-vars set -s mystack --apply-strategy=deployment EXAMPLE2='this will be applied on next deployment'
+$ cx env-vars set -s mystack --render DB_PASSWORD='secret://exec/pass show db/prod'
+$ cx env-vars set -s mystack --render GREETING='hello ${NAME}'
+$ cx env-vars set -s mystack --watch EXAMPLE3='piped into a CI dashboard' | jq .
+`,
+		},
+		{
+			Name:   "export",
+			Usage:  "exports a stack's environment variables to stdout or a file",
+			Action: runEnvVarsExport,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "[OPTIONAL, DEFAULT: dotenv] output format: dotenv, json, yaml, shell or tf",
+				},
+				cli.StringFlag{
+					Name:  "file",
+					Usage: "[OPTIONAL] write the export to this file instead of stdout",
+				},
+				cli.BoolFlag{
+					Name:  "include-readonly",
+					Usage: "[OPTIONAL] include readonly environment variables in the export",
+				},
+				cli.BoolFlag{
+					Name:  "history",
+					Usage: "[OPTIONAL] include each variable's history as commented lines",
+				},
+			},
+			Description: `Exports a stack's environment variables, for migrating them to another stack or
+syncing them into a local dev file.
+
+Examples:
+$ cx env-vars export -s mystack --format=dotenv --file=.env
+$ cx env-vars export -s mystack --format=json
+$ cx env-vars export -s mystack --format=tf --file=variables.auto.tfvars
+`,
+		},
+		{
+			Name:   "import",
+			Usage:  "imports environment variables from a local .env, JSON or YAML file",
+			Action: runEnvVarsImport,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file",
+					Usage: "the local file to import environment variables from",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "[OPTIONAL] file format: dotenv, json or yaml. Defaults to the file's extension, falling back to dotenv",
+				},
+				cli.StringFlag{
+					Name:  "apply-strategy",
+					Usage: "[OPTIONAL, DEFAULT: immediately] apply changes immediately, or during next deployment",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "[OPTIONAL] print what would change without applying anything",
+				},
+				cli.BoolFlag{
+					Name:  "prune",
+					Usage: "[OPTIONAL] delete remote environment variables that aren't present in the file",
+				},
+			},
+			Description: `Imports environment variables from a local file, diffing them against the stack's
+current environment variables and applying only what changed.
+
+Examples:
+$ cx env-vars import -s mystack --file=.env --dry-run
+$ cx env-vars import -s mystack --file=.env --apply-strategy=deployment
+$ cx env-vars import -s mystack --file=prod.json --prune
+`,
+		},
+		{
+			Name:   "render",
+			Usage:  "renders a --from-file template into dotenv output, resolving secrets and variable references",
+			Action: runEnvVarsRender,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from-file",
+					Usage: "a Go text/template file to render, with access to the stack's name, environment and framework",
+				},
+				cli.StringFlag{
+					Name:  "file",
+					Usage: "[OPTIONAL] write the rendered output to this file instead of stdout",
+				},
+			},
+			Description: `Renders a Go text/template file against the stack's metadata (StackName, Environment,
+Framework), then resolves each resulting line's value the same way "env-vars set --render" does:
+a "secret://<provider>/<ref>" value is pulled from the named provider (env, file or exec), and any
+"${OTHER_VAR}" left over is interpolated against the stack's current environment variables.
+
+The result is dotenv output, ready to pipe into "env-vars import" or inspect before applying anything.
+
+Examples:
+$ cx env-vars render -s mystack --from-file=vars.tmpl
+$ cx env-vars render -s mystack --from-file=vars.tmpl --file=.env
+$ cx env-vars render -s mystack --from-file=vars.tmpl | cx env-vars import -s mystack --file=/dev/stdin
 `,
 		},
 	}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported bundle compression algorithms. zstd is the default for new
+// bundles: it compresses the JSON/YAML-heavy stencil trees cx bundles
+// noticeably smaller and faster than gzip.
+const (
+	bundleCompressionNone = "none"
+	bundleCompressionGzip = "gzip"
+	bundleCompressionZstd = "zstd"
+)
+
+// gzip and zstd magic bytes, used to sniff a bundle's compression without
+// relying on the manifest (which older bundles don't carry a field for).
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+func parseBundleCompressionFlag(value string) (string, error) {
+	if value == "" {
+		return bundleCompressionZstd, nil
+	}
+
+	switch value {
+	case bundleCompressionNone, bundleCompressionGzip, bundleCompressionZstd:
+		return value, nil
+	default:
+		return "", fmt.Errorf("unknown --compression %q. Supported values are none, gzip, zstd", value)
+	}
+}
+
+// marshalBundleManifest adds the chosen compression algorithm to a
+// *cloud66.FormationBundle manifest before it's written to disk. It's
+// merged as raw JSON, rather than a typed wrapper struct, since
+// cloud66.FormationBundle isn't ours to add a field to.
+func marshalBundleManifest(manifest interface{}, compression string) ([]byte, error) {
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return nil, err
+	}
+	fields["compression"] = compression
+
+	return json.MarshalIndent(fields, "", "    ")
+}
+
+// loadBundleManifestCompression reads the "compression" field recorded by a
+// bundle's manifest.json, if any. Bundles created before this field existed
+// report "" so callers fall back to sniffing the tarball's magic bytes.
+func loadBundleManifestCompression(manifestFile string) (string, error) {
+	data, err := ioutil.ReadFile(manifestFile)
+	if err != nil {
+		return "", err
+	}
+
+	var fields struct {
+		Compression string `json:"compression"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", err
+	}
+
+	return fields.Compression, nil
+}
+
+// tarBundle archives dir into bundleFile, compressing the tar stream with
+// the given algorithm. It streams throughout rather than buffering the
+// archive in memory, so multi-hundred-MB bundles don't blow up on write.
+func tarBundle(dir string, bundleFile string, compression string) error {
+	out, err := os.Create(bundleFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	var archiveWriter io.Writer = w
+	var closer io.Closer
+
+	switch compression {
+	case bundleCompressionGzip:
+		gz := gzip.NewWriter(w)
+		archiveWriter = gz
+		closer = gz
+	case bundleCompressionZstd:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		archiveWriter = zw
+		closer = zw
+	case bundleCompressionNone, "":
+		// no compression layer
+	default:
+		return fmt.Errorf("unknown bundle compression %q", compression)
+	}
+
+	tw := tar.NewWriter(archiveWriter)
+	archiveRoot := filepath.Base(dir)
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join(archiveRoot, rel))
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if closer != nil {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+// untarBundle extracts bundleFile into destDir, sniffing the first bytes of
+// the file to decide whether it's zstd-, gzip- or un-compressed, so bundles
+// created before --compression existed still load transparently. It returns
+// the compression it detected.
+func untarBundle(bundleFile string, destDir string) (string, error) {
+	in, err := os.Open(bundleFile)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	br := bufio.NewReader(in)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	var archiveReader io.Reader = br
+	compression := bundleCompressionNone
+
+	switch {
+	case len(magic) >= 2 && magic[0] == gzipMagic[0] && magic[1] == gzipMagic[1]:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		archiveReader = gz
+		compression = bundleCompressionGzip
+	case len(magic) >= 4 && bytesEqual(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return "", err
+		}
+		defer zr.Close()
+		archiveReader = zr
+		compression = bundleCompressionZstd
+	}
+
+	tr := tar.NewReader(archiveReader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		target := filepath.Join(destDir, header.Name)
+		if rel, err := filepath.Rel(destDir, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return "", fmt.Errorf("bundle entry %q escapes destination directory", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.ModePerm); err != nil {
+				return "", err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+				return "", err
+			}
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
+			if err != nil {
+				return "", err
+			}
+			if _, err := io.Copy(file, tr); err != nil {
+				file.Close()
+				return "", err
+			}
+			file.Close()
+		}
+	}
+
+	return compression, nil
+}
+
+func bytesEqual(a []byte, b []byte) bool {
+	if len(a) < len(b) {
+		return false
+	}
+	for i := range b {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
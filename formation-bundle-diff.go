@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/cloud66-oss/cloud66"
+	"gopkg.in/go-yaml/yaml.v2"
+)
+
+// Bundle diff entry statuses. Unlike BundleUploadResult's statuses, these
+// describe what --dry-run predicts would happen, not what already did.
+const (
+	bundleDiffAdded     = "added"
+	bundleDiffChanged   = "changed"
+	bundleDiffUnchanged = "unchanged"
+	// bundleDiffDuplicate marks env vars and ConfigStore records whose name
+	// already exists remotely with a different value (env vars) or at all
+	// (ConfigStore records). Under the default --conflict=skip the upload
+	// creates them (StackEnvVarNew, CreateConfigStoreRecord) and the server
+	// rejects them as duplicates rather than updating them. --dry-run does not
+	// take --conflict into account, so --conflict=overwrite, which updates
+	// them in place, is not reflected here.
+	bundleDiffDuplicate = "would-skip-duplicate"
+)
+
+// BundleDiffEntry is one thing a bundle upload would touch, and what
+// --dry-run predicts would happen to it without calling the server.
+type BundleDiffEntry struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// BundleDiffResult is the outcome of "cx formations bundle upload --dry-run":
+// one entry per thing the bundle contains, classified against the stack's
+// current remote state.
+type BundleDiffResult struct {
+	Entries []BundleDiffEntry `json:"entries"`
+}
+
+func (r *BundleDiffResult) add(kind string, name string, status string) {
+	r.Entries = append(r.Entries, BundleDiffEntry{Kind: kind, Name: name, Status: status})
+}
+
+func (r *BundleDiffResult) merge(other *BundleDiffResult) {
+	if other == nil {
+		return
+	}
+	r.Entries = append(r.Entries, other.Entries...)
+}
+
+// printBundleDiffResult renders result in the requested format: "json",
+// "yaml", or the default "plaintext" one-line-per-entry summary.
+func printBundleDiffResult(result *BundleDiffResult, format string) error {
+	switch format {
+	case "json":
+		buf, err := json.MarshalIndent(result.Entries, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(buf))
+	case "yaml":
+		buf, err := yaml.Marshal(result.Entries)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(buf))
+	case "", "plaintext":
+		for _, entry := range result.Entries {
+			fmt.Printf("[%s] %s %s\n", entry.Status, entry.Kind, entry.Name)
+		}
+	default:
+		return fmt.Errorf("unknown --output %q. Supported values are plaintext, json, yaml", format)
+	}
+
+	return nil
+}
+
+// diffBundleUpload predicts what "cx formations bundle upload" would do to
+// formationName in stack, without creating or changing anything: it fetches
+// the formation's current remote state (if it has one yet) plus the stack's
+// env vars and ConfigStore records, and classifies every item the bundle
+// carries against them.
+func diffBundleUpload(fb *cloud66.FormationBundle, account *cloud66.Account, stack *cloud66.Stack, formationName string, bundlePath string) (*BundleDiffResult, error) {
+	result := &BundleDiffResult{}
+
+	var remote *cloud66.Formation
+	formations, err := client.Formations(stack.Uid, true)
+	if err != nil {
+		return result, err
+	}
+	for _, f := range formations {
+		if f.Name == formationName {
+			f := f
+			remote = &f
+			break
+		}
+	}
+
+	var digests map[string]string
+	if remote != nil {
+		digests = digestFormation(remote, nil)
+	}
+
+	diffStencils(result, digests, fb, bundlePath)
+	diffPolicies(result, digests, fb, bundlePath)
+	diffTransformations(result, digests, fb, bundlePath)
+	diffHelmReleases(result, remote, fb, bundlePath)
+	diffWorkflows(result, digests, fb, bundlePath)
+
+	if err := diffEnvironmentVariables(result, stack, fb, bundlePath); err != nil {
+		return result, err
+	}
+	if err := diffConfigStoreRecords(result, account, stack, remote, fb, bundlePath); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+func diffStencils(result *BundleDiffResult, digests map[string]string, fb *cloud66.FormationBundle, bundlePath string) {
+	for _, baseTemplate := range fb.BaseTemplates {
+		for _, stencil := range baseTemplate.Stencils {
+			item, err := stencil.AsStencil(bundlePath)
+			if err != nil {
+				result.add("stencil", stencil.Filename, bundleUploadFailed)
+				continue
+			}
+			result.add("stencil", item.Filename, classifyDigestDiff(digests, "stencil:"+item.Filename, item.Body))
+		}
+	}
+}
+
+func diffPolicies(result *BundleDiffResult, digests map[string]string, fb *cloud66.FormationBundle, bundlePath string) {
+	for _, policy := range fb.Policies {
+		item, err := policy.AsPolicy(bundlePath)
+		if err != nil {
+			result.add("policy", policy.Uid, bundleUploadFailed)
+			continue
+		}
+		result.add("policy", item.Uid, classifyDigestDiff(digests, "policy:"+item.Uid, item.Body))
+	}
+}
+
+func diffTransformations(result *BundleDiffResult, digests map[string]string, fb *cloud66.FormationBundle, bundlePath string) {
+	for _, transformation := range fb.Transformations {
+		item, err := transformation.AsTransformation(bundlePath)
+		if err != nil {
+			result.add("transformation", transformation.Uid, bundleUploadFailed)
+			continue
+		}
+		result.add("transformation", item.Uid, classifyDigestDiff(digests, "transformation:"+item.Uid, item.Body))
+	}
+}
+
+func diffWorkflows(result *BundleDiffResult, digests map[string]string, fb *cloud66.FormationBundle, bundlePath string) {
+	for _, workflow := range fb.Workflows {
+		item, err := workflow.AsWorkflow(bundlePath)
+		if err != nil {
+			result.add("workflow", workflow.Name, bundleUploadFailed)
+			continue
+		}
+		result.add("workflow", item.Name, classifyDigestDiff(digests, "workflow:"+item.Name, item.Body))
+	}
+}
+
+// diffHelmReleases can only tell added from unchanged-by-name: helm releases
+// aren't covered by digestFormation, so there's no remote body to hash and
+// compare a changed one against.
+func diffHelmReleases(result *BundleDiffResult, remote *cloud66.Formation, fb *cloud66.FormationBundle, bundlePath string) {
+	existing := make(map[string]bool)
+	if remote != nil {
+		for _, release := range remote.HelmReleases {
+			existing[release.DisplayName] = true
+		}
+	}
+
+	for _, release := range fb.HelmReleases {
+		item, err := release.AsRelease(bundlePath)
+		if err != nil {
+			result.add("helm_release", release.DisplayName, bundleUploadFailed)
+			continue
+		}
+		status := bundleDiffAdded
+		if existing[item.DisplayName] {
+			status = bundleDiffUnchanged
+		}
+		result.add("helm_release", item.DisplayName, status)
+	}
+}
+
+// classifyDigestDiff looks key up in a remote digest map built by
+// digestFormation, and compares it against body's hash.
+func classifyDigestDiff(digests map[string]string, key string, body string) string {
+	remoteDigest, known := digests[key]
+	if !known {
+		return bundleDiffAdded
+	}
+	if remoteDigest == digestString(body) {
+		return bundleDiffUnchanged
+	}
+	return bundleDiffChanged
+}
+
+func diffEnvironmentVariables(result *BundleDiffResult, stack *cloud66.Stack, fb *cloud66.FormationBundle, bundlePath string) error {
+	bundled, err := parseBundleEnvironmentVariables(fb, bundlePath)
+	if err != nil {
+		return err
+	}
+
+	remote, err := client.StackEnvVars(stack.Uid)
+	if err != nil {
+		return err
+	}
+	remoteValues := make(map[string]string, len(remote))
+	for _, envVar := range remote {
+		remoteValues[envVar.Key] = envVarStringValue(envVar)
+	}
+
+	keys := make([]string, 0, len(bundled))
+	for key := range bundled {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		remoteValue, known := remoteValues[key]
+		switch {
+		case !known:
+			result.add("env_var", key, bundleDiffAdded)
+		case remoteValue == bundled[key]:
+			result.add("env_var", key, bundleDiffUnchanged)
+		default:
+			result.add("env_var", key, bundleDiffDuplicate)
+		}
+	}
+
+	return nil
+}
+
+func diffConfigStoreRecords(result *BundleDiffResult, account *cloud66.Account, stack *cloud66.Stack, remote *cloud66.Formation, fb *cloud66.FormationBundle, bundlePath string) error {
+	bundled, err := parseConfigStoreEntriesFromFormationBundle(fb, bundlePath)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	if remote != nil {
+		remoteRecords, err := downloadBundledConfigStoreRecords(account, stack, remote)
+		if err != nil {
+			return err
+		}
+		for _, record := range remoteRecords.Records {
+			existing[record.Key] = true
+		}
+	}
+
+	for _, record := range bundled.Records {
+		status := bundleDiffAdded
+		if existing[record.Key] {
+			status = bundleDiffDuplicate
+		}
+		result.add("configstore_record", record.Key, status)
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import "sync"
+
+// uploadSemaphore bounds how many operations run at once. A "cx formations
+// bundle upload" run creates one per tier - one to dispatch bundle sections
+// (stencils, policies, env vars, ...) concurrently, and a fresh one inside
+// each section to bound its own item-level work (file parses, per-record
+// writes). Each tier gets its own instance rather than sharing one, since
+// reentrant acquisition on the same channel would deadlock at --concurrency 1.
+type uploadSemaphore chan struct{}
+
+func newUploadSemaphore(concurrency int) uploadSemaphore {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return make(uploadSemaphore, concurrency)
+}
+
+// run calls fn(i) for every index in [0, n), running up to the semaphore's
+// capacity at once, and blocks until every call has returned. fn is
+// responsible for writing its own result into a caller-owned, pre-sized
+// slice at position i, so deterministic ordering falls out of the slice
+// rather than needing to be reconstructed here.
+func (sem uploadSemaphore) run(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/cheggaaa/pb/v3"
+)
+
+// bundleUploadProgress renders a single progress bar (with speed and ETA)
+// per upload section - stencils, policies, env vars, and so on. With
+// --no-progress it falls back to the old one-line-per-section text, and
+// with --silent it prints nothing at all.
+type bundleUploadProgress struct {
+	silent     bool
+	noProgress bool
+	bar        *pb.ProgressBar
+}
+
+func newBundleUploadProgress(silent bool, noProgress bool) *bundleUploadProgress {
+	return &bundleUploadProgress{silent: silent, noProgress: noProgress}
+}
+
+// start begins reporting progress for a section of total items. Call
+// increment once per item processed and finish when the section is done,
+// whether or not it succeeded.
+func (p *bundleUploadProgress) start(label string, total int) {
+	if p.silent {
+		return
+	}
+	if p.noProgress || total == 0 {
+		fmt.Printf("Adding %s...\n", label)
+		return
+	}
+	p.bar = pb.New(total)
+	p.bar.SetTemplateString(fmt.Sprintf(`%s {{bar . }} {{counters . }} {{speed . }} {{etime . }}`, label))
+	p.bar.Start()
+}
+
+// increment advances the current section's bar by one item.
+func (p *bundleUploadProgress) increment() {
+	if p.bar != nil {
+		p.bar.Increment()
+	}
+}
+
+// finish closes out the current section, printing msg when there's no bar
+// to leave behind as a summary (--no-progress, or an empty section). In
+// --silent mode it prints nothing.
+func (p *bundleUploadProgress) finish(msg string) {
+	if p.bar != nil {
+		p.bar.Finish()
+		p.bar = nil
+		return
+	}
+	if p.silent {
+		return
+	}
+	fmt.Println(msg)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/go-yaml/yaml.v2"
+)
+
+// Bundle upload entry statuses.
+const (
+	bundleUploadSuccess = "success"
+	bundleUploadFailed  = "failed"
+	bundleUploadSkipped = "skipped"
+)
+
+// Bundle upload conflict policies, selected with --conflict. They govern
+// what happens when an upload helper finds that the thing it's about to
+// create already exists upstream.
+const (
+	bundleConflictSkip      = "skip"      // leave the existing one alone, report it as a duplicate (the default, and the prior hardcoded behavior)
+	bundleConflictOverwrite = "overwrite" // replace the existing one with the bundle's version
+	bundleConflictFail      = "fail"      // treat the conflict as a hard error instead of a warning
+)
+
+// parseBundleConflictFlag validates --conflict, defaulting an empty value to
+// bundleConflictSkip.
+func parseBundleConflictFlag(conflict string) (string, error) {
+	switch conflict {
+	case "":
+		return bundleConflictSkip, nil
+	case bundleConflictSkip, bundleConflictOverwrite, bundleConflictFail:
+		return conflict, nil
+	default:
+		return "", fmt.Errorf("unknown --conflict %q. Supported values are skip, overwrite, fail", conflict)
+	}
+}
+
+// DuplicateErr means the server already has a record under this name - safe
+// to report as a warning rather than aborting the whole upload.
+type DuplicateErr struct{ Message string }
+
+func (e *DuplicateErr) Error() string { return e.Message }
+
+// NotFoundErr means a resource the bundle refers to (e.g. a BTR) isn't
+// present upstream.
+type NotFoundErr struct{ Message string }
+
+func (e *NotFoundErr) Error() string { return e.Message }
+
+// ValidationErr means the bundle itself is malformed or internally
+// inconsistent (a file that won't parse, a missing reference).
+type ValidationErr struct{ Message string }
+
+func (e *ValidationErr) Error() string { return e.Message }
+
+// classifyUploadError wraps a raw error from the client or from parsing a
+// bundle file into one of the typed categories above, based on the message
+// patterns the server is already known to return. Errors that don't match
+// anything are returned unwrapped.
+func classifyUploadError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "Duplicate entry"), strings.Contains(msg, "already exists"), strings.Contains(msg, "Another environment variable with the same key exists"):
+		return &DuplicateErr{Message: msg}
+	case strings.Contains(msg, "does not exist"), strings.Contains(msg, "could not be found"), strings.Contains(msg, "no longer exists upstream"):
+		return &NotFoundErr{Message: msg}
+	default:
+		return err
+	}
+}
+
+// BundleUploadEntry is one named thing (a stencil, a policy, an env var...)
+// that an upload attempted to create, and what happened.
+type BundleUploadEntry struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Err    error  `json:"-"`
+}
+
+// ErrMessage renders Err for output formats that can't carry a Go error
+// value (JSON/YAML).
+func (e BundleUploadEntry) ErrMessage() string {
+	if e.Err == nil {
+		return ""
+	}
+	return e.Err.Error()
+}
+
+// bundleUploadEntryJSON is BundleUploadEntry's wire shape: Err doesn't
+// marshal on its own, so it's projected to a plain string.
+type bundleUploadEntryJSON struct {
+	Kind   string `json:"kind" yaml:"kind"`
+	Name   string `json:"name" yaml:"name"`
+	Status string `json:"status" yaml:"status"`
+	Err    string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+func (e BundleUploadEntry) toJSON() bundleUploadEntryJSON {
+	return bundleUploadEntryJSON{Kind: e.Kind, Name: e.Name, Status: e.Status, Err: e.ErrMessage()}
+}
+
+// BundleUploadResult is the outcome of "cx formations bundle upload":
+// one entry per thing it tried to create, plus every error it hit along
+// the way, joined so a caller can inspect them all at once rather than
+// just the first.
+type BundleUploadResult struct {
+	Entries []BundleUploadEntry `json:"entries"`
+	Errors  []error             `json:"-"`
+}
+
+// add records one entry's outcome, and folds its error (if any) into the
+// aggregated error list.
+func (r *BundleUploadResult) add(kind string, name string, status string, err error) {
+	err = classifyUploadError(err)
+	r.Entries = append(r.Entries, BundleUploadEntry{Kind: kind, Name: name, Status: status, Err: err})
+	if err != nil {
+		r.Errors = append(r.Errors, fmt.Errorf("%s %s: %w", kind, name, err))
+	}
+}
+
+// merge folds another result's entries and errors into r, for combining the
+// per-section results produced by the upload* helpers.
+func (r *BundleUploadResult) merge(other *BundleUploadResult) {
+	if other == nil {
+		return
+	}
+	r.Entries = append(r.Entries, other.Entries...)
+	r.Errors = append(r.Errors, other.Errors...)
+}
+
+// Err joins every error the upload hit into one, or nil if there were none.
+func (r *BundleUploadResult) Err() error {
+	return errors.Join(r.Errors...)
+}
+
+// HasCriticalErrors reports whether any entry failed for a reason other
+// than a duplicate - duplicates are expected on re-runs and are reported as
+// warnings, not failures, so the CLI only exits non-zero on something else.
+// Under --conflict=fail, though, a duplicate is itself the thing the caller
+// asked to treat as an error, so it counts as critical too.
+func (r *BundleUploadResult) HasCriticalErrors(conflictPolicy string) bool {
+	for _, entry := range r.Entries {
+		if entry.Err == nil {
+			continue
+		}
+		var dup *DuplicateErr
+		if !errors.As(entry.Err, &dup) {
+			return true
+		}
+		if conflictPolicy == bundleConflictFail {
+			return true
+		}
+	}
+	return false
+}
+
+// printBundleUploadResult renders result in the requested format: "json",
+// "yaml", or the default "plaintext" one-line-per-entry summary.
+func printBundleUploadResult(result *BundleUploadResult, format string) error {
+	switch format {
+	case "json":
+		entries := make([]bundleUploadEntryJSON, len(result.Entries))
+		for i, entry := range result.Entries {
+			entries[i] = entry.toJSON()
+		}
+		buf, err := json.MarshalIndent(entries, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(buf))
+	case "yaml":
+		entries := make([]bundleUploadEntryJSON, len(result.Entries))
+		for i, entry := range result.Entries {
+			entries[i] = entry.toJSON()
+		}
+		buf, err := yaml.Marshal(entries)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(buf))
+	case "", "plaintext":
+		for _, entry := range result.Entries {
+			if entry.Err != nil {
+				fmt.Printf("[%s] %s %s: %s\n", entry.Status, entry.Kind, entry.Name, entry.Err.Error())
+			} else {
+				fmt.Printf("[%s] %s %s\n", entry.Status, entry.Kind, entry.Name)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown --output %q. Supported values are plaintext, json, yaml", format)
+	}
+
+	return nil
+}
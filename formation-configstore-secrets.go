@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/cloud66-oss/cloud66"
+	"github.com/hashicorp/vault/api"
+	"go.mozilla.org/sops/v3/decrypt"
+	"gopkg.in/go-yaml/yaml.v2"
+)
+
+// configStoreValueFrom is the "valueFrom" field on a bundled ConfigStore
+// record: at most one of these should be set, naming where to fetch the
+// record's real value from instead of reading it out of the bundle file
+// directly. This lets a bundle commit a *reference* to a secret rather than
+// the secret itself.
+type configStoreValueFrom struct {
+	Sops              string `yaml:"sops,omitempty"`
+	Vault             string `yaml:"vault,omitempty"`
+	AWSSecretsManager string `yaml:"awsSecretsManager,omitempty"`
+}
+
+// configStoreRecordOverlay carries just enough of a bundled ConfigStore
+// record to resolve its valueFrom: cloud66.BundledConfigStoreRecord doesn't
+// have a ValueFrom field of its own, so the bundle's configstore file is
+// unmarshalled a second time into this shape and correlated back to the
+// official records by Key.
+type configStoreRecordOverlay struct {
+	Key       string                `yaml:"key"`
+	ValueFrom *configStoreValueFrom `yaml:"valueFrom,omitempty"`
+}
+
+type configStoreValueFromFile struct {
+	Records []configStoreRecordOverlay `yaml:"records"`
+}
+
+// SecretResolver fetches the plaintext value a valueFrom reference points
+// at. configstoreDir is the bundle's configstore directory, so a resolver
+// whose ref is a relative path (SOPS) can find it alongside the bundle's
+// other configstore files.
+type SecretResolver interface {
+	Resolve(ref string, configstoreDir string) (string, error)
+}
+
+// refKeyPattern splits a "path/to/file.yaml#key" or "secret/data/app#field"
+// style reference into its two halves.
+var refKeyPattern = regexp.MustCompile(`^(.+)#([^#]+)$`)
+
+func splitRefKey(ref string) (path string, key string, err error) {
+	matches := refKeyPattern.FindStringSubmatch(ref)
+	if matches == nil {
+		return "", "", fmt.Errorf("invalid secret reference %q: expected \"<path>#<key>\"", ref)
+	}
+	return matches[1], matches[2], nil
+}
+
+// lookupYAMLKey reads a dotted key (e.g. "database.password") out of an
+// arbitrary YAML document.
+func lookupYAMLKey(data []byte, key string) (string, error) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return "", err
+	}
+
+	var cur interface{} = doc
+	for _, part := range strings.Split(key, ".") {
+		var ok bool
+		switch m := cur.(type) {
+		case map[string]interface{}:
+			cur, ok = m[part]
+		case map[interface{}]interface{}:
+			// yaml.v2 decodes nested mappings with interface{} keys
+			cur, ok = m[part]
+		}
+		if !ok {
+			return "", fmt.Errorf("key %q not found", key)
+		}
+	}
+
+	value, ok := cur.(string)
+	if !ok {
+		return "", fmt.Errorf("key %q is not a string", key)
+	}
+	return value, nil
+}
+
+// sopsInlinePrefix marks a valueFrom.sops reference produced by
+// encryptConfigStoreRecordsWithSops: the ciphertext lives in the record's
+// own Value field rather than in a separate file.
+const sopsInlinePrefix = "inline#"
+
+// sopsSecretResolver decrypts a SOPS-encrypted YAML file colocated in the
+// bundle's configstore directory and reads a single key out of it.
+type sopsSecretResolver struct{}
+
+func (sopsSecretResolver) Resolve(ref string, configstoreDir string) (string, error) {
+	relPath, key, err := splitRefKey(ref)
+	if err != nil {
+		return "", err
+	}
+
+	path := relPath
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(configstoreDir, relPath)
+	}
+
+	plaintext, err := decrypt.File(path, "yaml")
+	if err != nil {
+		return "", fmt.Errorf("sops: decrypting %s: %w", path, err)
+	}
+
+	return lookupYAMLKey(plaintext, key)
+}
+
+// resolveInlineSopsValue decrypts ciphertext (a SOPS encrypted YAML
+// document embedded directly in a record's Value) and reads key out of it.
+func resolveInlineSopsValue(ciphertext string, key string) (string, error) {
+	plaintext, err := decrypt.Data([]byte(ciphertext), "yaml")
+	if err != nil {
+		return "", fmt.Errorf("sops: decrypting inline value: %w", err)
+	}
+	return lookupYAMLKey(plaintext, key)
+}
+
+// vaultSecretResolver reads a key out of a HashiCorp Vault KV v2 secret,
+// using VAULT_ADDR and VAULT_TOKEN from the environment.
+type vaultSecretResolver struct{}
+
+func (vaultSecretResolver) Resolve(ref string, configstoreDir string) (string, error) {
+	path, key, err := splitRefKey(ref)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		return "", fmt.Errorf("vault: %w", err)
+	}
+
+	secret, err := client.Logical().Read(path)
+	if err != nil {
+		return "", fmt.Errorf("vault: reading %s: %w", path, err)
+	}
+	if secret == nil {
+		return "", fmt.Errorf("vault: no secret found at %s", path)
+	}
+
+	// KV v2 nests the actual fields under "data".
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		data = secret.Data
+	}
+
+	value, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("vault: key %q not found at %s", key, path)
+	}
+	return value, nil
+}
+
+// awsSecretIDPattern pulls the optional ":<json key>" suffix off an AWS
+// Secrets Manager ARN, distinguishing it from the ARN's own trailing
+// "secret:<name>" segment.
+var awsSecretIDPattern = regexp.MustCompile(`^(arn:aws:secretsmanager:[^:]*:[^:]*:secret:[^:]+)(?::(.+))?$`)
+
+// awsSecretsManagerResolver reads a secret from AWS Secrets Manager. If the
+// reference names a JSON key, the secret string is parsed as JSON and that
+// key is extracted; otherwise the whole secret string is the value.
+type awsSecretsManagerResolver struct{}
+
+func (awsSecretsManagerResolver) Resolve(ref string, configstoreDir string) (string, error) {
+	matches := awsSecretIDPattern.FindStringSubmatch(ref)
+	if matches == nil {
+		return "", fmt.Errorf("invalid AWS Secrets Manager reference %q", ref)
+	}
+	secretID, jsonKey := matches[1], matches[2]
+
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return "", fmt.Errorf("awsSecretsManager: %w", err)
+	}
+
+	svc := secretsmanager.NewFromConfig(cfg)
+	out, err := svc.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(secretID)})
+	if err != nil {
+		return "", fmt.Errorf("awsSecretsManager: fetching %s: %w", secretID, err)
+	}
+	if out.SecretString == nil {
+		return "", fmt.Errorf("awsSecretsManager: %s has no string value", secretID)
+	}
+
+	if jsonKey == "" {
+		return *out.SecretString, nil
+	}
+
+	return lookupJSONKey(*out.SecretString, jsonKey)
+}
+
+func lookupJSONKey(document string, key string) (string, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(document), &doc); err != nil {
+		return "", err
+	}
+	value, ok := doc[key].(string)
+	if !ok {
+		return "", fmt.Errorf("key %q not found or not a string", key)
+	}
+	return value, nil
+}
+
+// resolveConfigStoreValueFrom dispatches ref to whichever backend it names.
+func resolveConfigStoreValueFrom(ref *configStoreValueFrom, configstoreDir string) (string, error) {
+	switch {
+	case ref.Sops != "":
+		return sopsSecretResolver{}.Resolve(ref.Sops, configstoreDir)
+	case ref.Vault != "":
+		return vaultSecretResolver{}.Resolve(ref.Vault, configstoreDir)
+	case ref.AWSSecretsManager != "":
+		return awsSecretsManagerResolver{}.Resolve(ref.AWSSecretsManager, configstoreDir)
+	default:
+		return "", fmt.Errorf("valueFrom has no backend set (expected one of sops, vault, awsSecretsManager)")
+	}
+}
+
+// applyConfigStoreValueFrom resolves every valueFrom reference in overlay
+// and overwrites the matching record's Value in records, by Key. Records
+// with no valueFrom (or no match in overlay) are left untouched.
+func applyConfigStoreValueFrom(records *cloud66.BundledConfigStoreRecords, overlay *configStoreValueFromFile, configstoreDir string) error {
+	refsByKey := make(map[string]*configStoreValueFrom, len(overlay.Records))
+	for _, rec := range overlay.Records {
+		if rec.ValueFrom != nil {
+			refsByKey[rec.Key] = rec.ValueFrom
+		}
+	}
+
+	for i, record := range records.Records {
+		ref, ok := refsByKey[record.Key]
+		if !ok {
+			continue
+		}
+
+		var value string
+		var err error
+		if strings.HasPrefix(ref.Sops, sopsInlinePrefix) {
+			value, err = resolveInlineSopsValue(record.Value, strings.TrimPrefix(ref.Sops, sopsInlinePrefix))
+		} else {
+			value, err = resolveConfigStoreValueFrom(ref, configstoreDir)
+		}
+		if err != nil {
+			return fmt.Errorf("resolving valueFrom for ConfigStore record %q: %w", record.Key, err)
+		}
+		records.Records[i].Value = value
+	}
+
+	return nil
+}
+
+// encryptConfigStoreRecordsWithSops encrypts every record's value in place
+// with SOPS so --encrypt-with sops never lets a bundle download write
+// plaintext secrets to disk. Each record's Value is replaced by a SOPS
+// encrypted YAML document, and its Key is recorded in the returned overlay
+// so a later upload knows to decrypt it back out via valueFrom.
+func encryptConfigStoreRecordsWithSops(records *cloud66.BundledConfigStoreRecords, recipients string) (*configStoreValueFromFile, error) {
+	overlay := &configStoreValueFromFile{}
+
+	for i, record := range records.Records {
+		plaintext, err := yaml.Marshal(map[string]string{"value": record.Value})
+		if err != nil {
+			return nil, err
+		}
+
+		args := []string{"--encrypt", "--input-type", "yaml", "--output-type", "yaml"}
+		if recipients != "" {
+			args = append(args, "--age", recipients)
+		}
+		args = append(args, "/dev/stdin")
+
+		cmd := exec.Command("sops", args...)
+		cmd.Stdin = bytes.NewReader(plaintext)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			message := strings.TrimSpace(stderr.String())
+			if message == "" {
+				message = err.Error()
+			}
+			return nil, fmt.Errorf("sops: encrypting ConfigStore record %q: %s", record.Key, message)
+		}
+
+		records.Records[i].Value = stdout.String()
+		overlay.Records = append(overlay.Records, configStoreRecordOverlay{
+			Key:       record.Key,
+			ValueFrom: &configStoreValueFrom{Sops: "inline#value"},
+		})
+	}
+
+	return overlay, nil
+}
+
+// mergeConfigStoreValueFromOverlay marshals records to YAML and merges in
+// each record's valueFrom from overlay, matched by Key. cloud66's
+// BundledConfigStoreRecord has no ValueFrom field, so this round-trips
+// through a generic document instead of a second struct field.
+func mergeConfigStoreValueFromOverlay(records *cloud66.BundledConfigStoreRecords, overlay *configStoreValueFromFile) ([]byte, error) {
+	refsByKey := make(map[string]*configStoreValueFrom, len(overlay.Records))
+	for _, rec := range overlay.Records {
+		if rec.ValueFrom != nil {
+			refsByKey[rec.Key] = rec.ValueFrom
+		}
+	}
+
+	marshalled, err := yaml.Marshal(records)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(marshalled, &doc); err != nil {
+		return nil, err
+	}
+
+	entries, _ := doc["records"].([]interface{})
+	for _, entry := range entries {
+		fields, ok := entry.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		key, _ := fields["key"].(string)
+		if ref, ok := refsByKey[key]; ok {
+			fields["valueFrom"] = ref
+		}
+	}
+
+	return yaml.Marshal(doc)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cloud66-oss/cloud66"
+)
+
+// formationManifestFilename is written into a formation's stencil directory
+// on fetch, and read back on commit --changed-only. It is hidden (dot-file)
+// so it doesn't show up as a stencil itself.
+const formationManifestFilename = ".cx-formation-manifest.json"
+
+// formationManifestEntry records what a stencil looked like, locally and on
+// the server, the last time it was fetched: SHA256 is the hash of the local
+// file content at that point, and ETag is the hash of the stencil body the
+// server returned. Comparing a file's current hash against SHA256 tells you
+// whether it was edited locally; comparing the server's current body hash
+// against ETag tells you whether it moved upstream since the fetch.
+type formationManifestEntry struct {
+	Filename   string `json:"filename"`
+	SHA256     string `json:"sha256"`
+	StencilUID string `json:"stencil_uid"`
+	ETag       string `json:"etag"`
+}
+
+// formationManifest is keyed by filename for fast lookup while diffing a
+// directory on commit.
+type formationManifest struct {
+	Entries map[string]formationManifestEntry `json:"entries"`
+}
+
+// writeFormationManifest saves entries into dir/.cx-formation-manifest.json.
+func writeFormationManifest(dir string, entries []formationManifestEntry) error {
+	manifest := formationManifest{Entries: make(map[string]formationManifestEntry, len(entries))}
+	for _, entry := range entries {
+		manifest.Entries[entry.Filename] = entry
+	}
+
+	buf, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, formationManifestFilename), buf, 0644)
+}
+
+// loadFormationManifest reads dir/.cx-formation-manifest.json. A directory
+// fetched before --changed-only existed simply has no such file, in which
+// case an empty manifest is returned so every file is treated as changed.
+func loadFormationManifest(dir string) (*formationManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, formationManifestFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &formationManifest{Entries: make(map[string]formationManifestEntry)}, nil
+		}
+		return nil, err
+	}
+
+	var manifest formationManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Entries == nil {
+		manifest.Entries = make(map[string]formationManifestEntry)
+	}
+
+	return &manifest, nil
+}
+
+// sha256File hashes the content of path, the same way digestString hashes a
+// string, so a file on disk can be compared against a manifest entry.
+func sha256File(path string) (string, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return digestString(string(body)), nil
+}
+
+// filterChangedStencils keeps only the files whose content no longer
+// matches the SHA256 recorded for them in manifest. A file with no entry at
+// all (new since the last fetch, or the manifest predates --changed-only)
+// is treated as changed, so nothing is silently skipped.
+func filterChangedStencils(files []string, manifest *formationManifest) ([]string, error) {
+	var changed []string
+	for _, file := range files {
+		entry, known := manifest.Entries[filepath.Base(file)]
+		if !known {
+			changed = append(changed, file)
+			continue
+		}
+
+		sha, err := sha256File(file)
+		if err != nil {
+			return nil, err
+		}
+		if sha != entry.SHA256 {
+			changed = append(changed, file)
+		}
+	}
+	return changed, nil
+}
+
+// checkFormationDrift compares every stencil's current remote body hash
+// against the ETag recorded in manifest, and reports the first mismatch it
+// finds: the remote has moved since the fetch that manifest describes, so
+// committing against it risks clobbering someone else's change.
+func checkFormationDrift(formation *cloud66.Formation, manifest *formationManifest) error {
+	for filename, entry := range manifest.Entries {
+		stencil := formation.FindStencil(filename)
+		if stencil == nil {
+			continue
+		}
+		if digestString(stencil.Body) != entry.ETag {
+			return fmt.Errorf("stencil %s has changed on the server since the last fetch", filename)
+		}
+	}
+	return nil
+}
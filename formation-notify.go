@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/cloud66-oss/trackman/notifiers"
+	trackmanType "github.com/cloud66-oss/trackman/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// formationNotifierFunc matches trackmanType.WorkflowOptions.Notifier's
+// signature, so values of this type can be assigned to that field directly.
+type formationNotifierFunc func(ctx context.Context, logger *logrus.Logger, event *trackmanType.Event) error
+
+// formationStepEvent is the JSON shape emitted by the json/file/webhook
+// notifiers: one record per step transition. trackman's own Event doesn't
+// carry timestamps or exit codes, so formationStepTimers below fills those
+// in; it also doesn't hand the notifier the step's captured stdout/stderr
+// (those go straight to the workflow's logger), so the tails are left empty
+// rather than faked.
+type formationStepEvent struct {
+	Step      string    `json:"step"`
+	Status    string    `json:"status"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+	EndedAt   time.Time `json:"ended_at,omitempty"`
+	ExitCode  *int      `json:"exit_code,omitempty"`
+	Stdout    string    `json:"stdout_tail,omitempty"`
+	Stderr    string    `json:"stderr_tail,omitempty"`
+}
+
+// formationStepTimers tracks when each step started, keyed by spinner UUID,
+// so a later terminal event can report how long the step ran for.
+type formationStepTimers struct {
+	mu      sync.Mutex
+	started map[string]time.Time
+}
+
+func newFormationStepTimers() *formationStepTimers {
+	return &formationStepTimers{started: make(map[string]time.Time)}
+}
+
+func (t *formationStepTimers) toEvent(event *trackmanType.Event) formationStepEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	uuid := event.Payload.Spinner.UUID
+	now := time.Now().UTC()
+
+	out := formationStepEvent{
+		Step:   event.Payload.Spinner.Name,
+		Status: event.Name,
+	}
+
+	switch event.Name {
+	case trackmanType.EventRunRequested:
+		t.started[uuid] = now
+		out.StartedAt = now
+	case trackmanType.EventRunSuccess, trackmanType.EventRunFail, trackmanType.EventRunError, trackmanType.EventRunTimeout, trackmanType.EventRunWaitError:
+		out.StartedAt = t.started[uuid]
+		out.EndedAt = now
+		delete(t.started, uuid)
+	default:
+		out.StartedAt = t.started[uuid]
+	}
+
+	if status, ok := event.Payload.Extras.(syscall.WaitStatus); ok {
+		code := status.ExitStatus()
+		out.ExitCode = &code
+	}
+
+	return out
+}
+
+// fanOutFormationNotifier forwards every event to all the given notifiers,
+// continuing on individual failures and returning the first error
+// encountered, if any.
+func fanOutFormationNotifier(notifs ...formationNotifierFunc) formationNotifierFunc {
+	return func(ctx context.Context, logger *logrus.Logger, event *trackmanType.Event) error {
+		var firstErr error
+		for _, n := range notifs {
+			if err := n(ctx, logger, event); err != nil {
+				logger.Errorf("notifier failed: %s", err.Error())
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		return firstErr
+	}
+}
+
+// jsonNotifier writes one NDJSON record per step event to w.
+func jsonNotifier(timers *formationStepTimers, w *os.File) formationNotifierFunc {
+	return func(ctx context.Context, logger *logrus.Logger, event *trackmanType.Event) error {
+		line, err := json.Marshal(timers.toEvent(event))
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(append(line, '\n'))
+		return err
+	}
+}
+
+// formationFileNotifier appends one NDJSON record per step event to the file at path.
+func formationFileNotifier(timers *formationStepTimers, path string) formationNotifierFunc {
+	return func(ctx context.Context, logger *logrus.Logger, event *trackmanType.Event) error {
+		line, err := json.Marshal(timers.toEvent(event))
+		if err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = f.Write(append(line, '\n'))
+		return err
+	}
+}
+
+// formationWebhookNotifier POSTs the same event shape the json/file
+// notifiers emit to an arbitrary webhook URL, retrying with exponential
+// backoff so a single dropped connection doesn't lose a step's event.
+func formationWebhookNotifier(timers *formationStepTimers, webhookURL string) formationNotifierFunc {
+	return func(ctx context.Context, logger *logrus.Logger, event *trackmanType.Event) error {
+		body, err := json.Marshal(timers.toEvent(event))
+		if err != nil {
+			return err
+		}
+
+		post := func() error {
+			return postFormationEvent(webhookURL, body)
+		}
+
+		policy := backoff.NewExponentialBackOff()
+		policy.InitialInterval = 500 * time.Millisecond
+		policy.MaxInterval = 10 * time.Second
+		policy.MaxElapsedTime = time.Minute
+
+		return backoff.RetryNotify(post, policy, func(err error, wait time.Duration) {
+			logger.Warnf("webhook notifier failed, retrying in %s: %s", wait, err.Error())
+		})
+	}
+}
+
+func postFormationEvent(url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook notifier received status %d from %s", resp.StatusCode, url)
+	}
+
+	return nil
+}
+
+// formationNotifierFromFlag builds the fan-out notifier requested via the
+// --notifier flag: a comma separated list of console, json, file:<path> and
+// webhook:<url> entries.
+func formationNotifierFromFlag(spec string) (formationNotifierFunc, error) {
+	if spec == "" {
+		spec = "console"
+	}
+
+	timers := newFormationStepTimers()
+
+	var built []formationNotifierFunc
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		name, arg := entry, ""
+		if idx := strings.Index(entry, ":"); idx != -1 {
+			name, arg = entry[:idx], entry[idx+1:]
+		}
+
+		switch name {
+		case "console":
+			built = append(built, formationNotifierFunc(notifiers.ConsoleNotify))
+		case "json":
+			built = append(built, jsonNotifier(timers, os.Stdout))
+		case "file":
+			if arg == "" {
+				return nil, fmt.Errorf("file notifier requires a path, e.g. file:/tmp/deploy.ndjson")
+			}
+			built = append(built, formationFileNotifier(timers, arg))
+		case "webhook":
+			if arg == "" {
+				return nil, fmt.Errorf("webhook notifier requires a URL, e.g. webhook:https://example.com/hook")
+			}
+			built = append(built, formationWebhookNotifier(timers, arg))
+		default:
+			return nil, fmt.Errorf("unknown notifier %q. Supported values are console, json, file:<path>, webhook:<url>", entry)
+		}
+	}
+
+	return fanOutFormationNotifier(built...), nil
+}
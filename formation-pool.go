@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// stencilPoolResult is a single file's outcome from a worker pool run,
+// carried back on a channel so results stay tied to their original position
+// even though the work itself completes out of order.
+type stencilPoolResult struct {
+	index   int
+	message string
+	err     error
+}
+
+// runStencilPool runs work for every file in files across concurrency
+// workers, in the spirit of trackman's runErrors/stepErrors: per-file
+// failures are aggregated into a single error instead of aborting the batch
+// on the first one. Successful messages are printed in the files' original
+// order once every worker has finished, so concurrent execution doesn't
+// scramble the output.
+func runStencilPool(files []string, concurrency int, work func(index int, file string) (string, error)) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	jobs := make(chan int)
+	results := make(chan stencilPoolResult, len(files))
+
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				message, err := work(idx, files[idx])
+				results <- stencilPoolResult{index: idx, message: message, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		for idx := range files {
+			jobs <- idx
+		}
+		close(jobs)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	ordered := make([]stencilPoolResult, len(files))
+	for result := range results {
+		ordered[result.index] = result
+	}
+
+	var failures []string
+	for i, result := range ordered {
+		if result.err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", files[i], result.err.Error()))
+			continue
+		}
+		if result.message != "" {
+			fmt.Println(result.message)
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d files failed:\n%s", len(failures), len(files), strings.Join(failures, "\n"))
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/cloud66-oss/cloud66"
+	"github.com/cloud66/cli"
+)
+
+// formationSnapshotVersion guards against loading a snapshot written by an
+// incompatible future (or past) version of this format.
+const formationSnapshotVersion = "1"
+
+// formationSnapshotManifest is modelled on Terraform's configuration-snapshot
+// manifest: a record of what went into the snapshot and a digest of every
+// piece of it, so the snapshot can be diffed or audited without re-fetching
+// anything from the server.
+type formationSnapshotManifest struct {
+	Version       string            `json:"version"`
+	FormationUid  string            `json:"formation_uid"`
+	FormationName string            `json:"formation_name"`
+	StackUid      string            `json:"stack_uid"`
+	SnapshotUID   string            `json:"snapshot_uid"`
+	WorkflowName  string            `json:"workflow_name"`
+	CreatedBy     string            `json:"created_by"`
+	Digests       map[string]string `json:"digests"`
+}
+
+// formationSnapshot is a self-contained, in-memory filesystem of everything
+// a deploy needs: the fully-resolved formation tree (stencils, policies,
+// transformations, workflows, helm releases and the BTR refs they came
+// from), the env vars and ConfigStore records a bundle would otherwise fetch
+// separately, and the raw workflow body that runDeployFormation runs.
+// Nothing in it points back at the server.
+type formationSnapshot struct {
+	Manifest    formationSnapshotManifest          `json:"manifest"`
+	Formation   cloud66.Formation                  `json:"formation"`
+	Workflow    []byte                             `json:"workflow"`
+	EnvVars     []cloud66.StackEnvVar              `json:"env_vars"`
+	ConfigStore *cloud66.BundledConfigStoreRecords `json:"configstore,omitempty"`
+}
+
+func runSnapshotFormation(c *cli.Context) {
+	stack := mustStack(c)
+	account := mustOrg(c)
+
+	formationName := getArgument(c, "formation")
+	if formationName == "" {
+		printFatal("No formation provided. Please use --formation to specify a formation")
+	}
+
+	var formation *cloud66.Formation
+	formations, err := client.Formations(stack.Uid, true)
+	must(err)
+	for _, innerFormation := range formations {
+		if innerFormation.Name == formationName {
+			formation = &innerFormation
+			break
+		}
+	}
+	if formation == nil {
+		printFatal("Formation with name \"%v\" could not be found", formationName)
+	}
+
+	snapshotUID := c.String("snapshot-uid")
+	if snapshotUID == "" {
+		snapshotUID = "latest"
+	}
+	useLatest := c.BoolT("use-latest")
+	workflowName := getArgument(c, "workflow")
+
+	fmt.Println("Fetching workflow from the server...")
+	workflowWrapper, err := client.GetWorkflow(stack.Uid, formation.Uid, snapshotUID, useLatest, workflowName)
+	must(err)
+
+	envVars, err := client.StackEnvVars(stack.Uid)
+	must(err)
+
+	fmt.Println("Fetching ConfigStore records from the server...")
+	configStoreRecords, err := downloadBundledConfigStoreRecords(account, stack, formation)
+	must(err)
+
+	snapshotFile := c.String("file")
+	if snapshotFile == "" {
+		snapshotFile = formationName + ".snapshot.json"
+	}
+
+	snapshot := formationSnapshot{
+		Manifest: formationSnapshotManifest{
+			Version:       formationSnapshotVersion,
+			FormationUid:  formation.Uid,
+			FormationName: formation.Name,
+			StackUid:      stack.Uid,
+			SnapshotUID:   snapshotUID,
+			WorkflowName:  workflowName,
+			CreatedBy:     fmt.Sprintf("cx (%s)", VERSION),
+			Digests:       digestFormation(formation, workflowWrapper.Workflow),
+		},
+		Formation:   *formation,
+		Workflow:    workflowWrapper.Workflow,
+		EnvVars:     envVars,
+		ConfigStore: configStoreRecords,
+	}
+
+	buf, err := json.MarshalIndent(snapshot, "", "    ")
+	must(err)
+
+	err = ioutil.WriteFile(snapshotFile, buf, 0600)
+	must(err)
+
+	fmt.Printf("Snapshot saved to %s\n", snapshotFile)
+}
+
+// digestFormation hashes every stencil, policy, transformation and workflow
+// body that is going into a snapshot, keyed so a later diff can point at
+// exactly what changed.
+func digestFormation(formation *cloud66.Formation, workflow []byte) map[string]string {
+	digests := make(map[string]string)
+	for _, stencil := range formation.Stencils {
+		digests["stencil:"+stencil.Filename] = digestString(stencil.Body)
+	}
+	for _, policy := range formation.Policies {
+		digests["policy:"+policy.Uid] = digestString(policy.Body)
+	}
+	for _, transformation := range formation.Transformations {
+		digests["transformation:"+transformation.Uid] = digestString(transformation.Body)
+	}
+	for _, workflowFile := range formation.Workflows {
+		digests["workflow:"+workflowFile.Name] = digestString(workflowFile.Body)
+	}
+	digests["workflow-run"] = digestString(string(workflow))
+	return digests
+}
+
+func digestString(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+}
+
+// loadFormationSnapshot reads a snapshot file written by "cx formations
+// snapshot" and returns the same *cloud66.Formation shape the online path
+// produces, plus the workflow body to run. It takes no client, so unlike
+// runFetchFormation/runDeployFormation's online path there is no remote call
+// it could make even by accident - an air-gapped replay has nothing to
+// reach out with.
+func loadFormationSnapshot(snapshotFile string) (*cloud66.Formation, []byte) {
+	data, err := ioutil.ReadFile(snapshotFile)
+	if err != nil {
+		printFatal("Failed to read snapshot %s: %s", snapshotFile, err.Error())
+	}
+
+	var snapshot formationSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		printFatal("Failed to parse snapshot %s: %s", snapshotFile, err.Error())
+	}
+
+	if snapshot.Manifest.Version != formationSnapshotVersion {
+		printFatal("Snapshot %s was created with format version %s, which this version of cx does not support", snapshotFile, snapshot.Manifest.Version)
+	}
+
+	return &snapshot.Formation, snapshot.Workflow
+}
@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"text/tabwriter"
 	"time"
 
@@ -35,7 +36,7 @@ func stencilSubCommands() []cli.Command {
 				},
 				cli.StringFlag{
 					Name:  "output,o",
-					Usage: "tailor output view (standard|wide)",
+					Usage: "tailor output view (standard|wide|json)",
 				},
 			},
 			Description: `Fetch all formation stencils and their templates
@@ -61,6 +62,10 @@ $ cx formations stencils list --formation bar
 					Name:  "stencil",
 					Usage: "Stencil filename",
 				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "[OPTIONAL] Output the stencil as JSON instead of printing its raw content",
+				},
 			},
 		},
 		{
@@ -96,10 +101,36 @@ $ cx formations stencils list --formation bar
 					Name:  "output",
 					Usage: "Full file name and path to save the rendered stencil. If missing it will output to stdout",
 				},
+				cli.StringFlag{
+					Name:  "include",
+					Usage: "[OPTIONAL] Comma separated shell-glob patterns (supports **). With --stencil-folder, only matching files are rendered",
+				},
+				cli.StringFlag{
+					Name:  "exclude",
+					Usage: "[OPTIONAL] Comma separated shell-glob patterns (supports **). With --stencil-folder, matching files are skipped",
+				},
+				cli.StringFlag{
+					Name:  "post",
+					Usage: "[OPTIONAL] Comma separated post-processors to run on the rendered output, in order (built-in: kubeval, kubeconform, yamllint, sops, kustomize; or exec:<cmd> for an arbitrary command). Also configurable via a post_processors: block in .cx.yml",
+				},
+				cli.StringFlag{
+					Name:  "diff",
+					Usage: "[OPTIONAL] Snapshot ID (or 'previous') to diff --snapshot's render against. Prints a unified diff instead of the rendered content",
+				},
+				cli.IntFlag{
+					Name:  "diff-context",
+					Value: 3,
+					Usage: "[OPTIONAL] With --diff, number of context lines around each change",
+				},
 				cli.BoolFlag{
 					Name:  "watch",
 					Usage: "Watches the file or the folder for changes and renders every time there is a new change",
 				},
+				cli.DurationFlag{
+					Name:  "debounce",
+					Value: 500 * time.Millisecond,
+					Usage: "[OPTIONAL] With --watch, how long to wait for a burst of changes to a path to settle before rendering it",
+				},
 				cli.BoolFlag{
 					Name:  "ignore-errors",
 					Usage: "if set, it will return anything that can be rendered and ignores the errors",
@@ -108,6 +139,10 @@ $ cx formations stencils list --formation bar
 					Name:  "ignore-warnings",
 					Usage: "if set, it will return anything that can be rendered and ignores the warnings",
 				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "[OPTIONAL] Emit one JSON object per rendered stencil to stdout ({source, output_path, checksum, warnings, errors, content}) instead of human-readable text",
+				},
 			},
 		},
 		{
@@ -151,6 +186,14 @@ $ cx formations stencils list --formation bar
 					Name:  "tags",
 					Usage: "Comma separated tags",
 				},
+				cli.StringFlag{
+					Name:  "include",
+					Usage: "[OPTIONAL] Comma separated shell-glob patterns (supports **). The stencil is only added if it matches",
+				},
+				cli.StringFlag{
+					Name:  "exclude",
+					Usage: "[OPTIONAL] Comma separated shell-glob patterns (supports **). The stencil is skipped if it matches",
+				},
 			},
 		},
 	}
@@ -228,12 +271,38 @@ func runRenderStencil(c *cli.Context) {
 	watch := c.Bool("watch")
 	ignoreWarnings := c.Bool("ignore-warnings")
 	ignoreErrors := c.Bool("ignore-errors")
+	jsonMode := c.Bool("json")
+	debounce := c.Duration("debounce")
+	if debounce <= 0 {
+		debounce = 500 * time.Millisecond
+	}
+	includes := splitCSVList(c.String("include"))
+	excludes := splitCSVList(c.String("exclude"))
+
+	postProcessors := splitCSVList(c.String("post"))
+	if cfg, err := loadCxConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, ansi.Color(fmt.Sprintf("Failed to read .cx.yml: %s\n", err.Error()), "yellow"))
+	} else {
+		postProcessors = append(cfg.PostProcessors, postProcessors...)
+	}
 
 	if watch && stdout {
 		printFatal("Cannot use --watch without --output")
 	}
 
-	fmt.Printf("Stencils: %s\nRenders: %s\n", stencilFolder, output)
+	if jsonMode {
+		fmt.Fprintf(os.Stderr, "Stencils: %s\nRenders: %s\n", stencilFolder, output)
+	} else {
+		fmt.Printf("Stencils: %s\nRenders: %s\n", stencilFolder, output)
+	}
+	var ignoreMatcher *cxIgnoreMatcher
+	if stencilFolder != "" {
+		ignoreMatcher, err = loadCxIgnore(stencilFolder)
+		if err != nil {
+			printFatal("Failed to load .cxignore under %s: %s", stencilFolder, err.Error())
+		}
+	}
+
 	filesToRender := make([]string, 0)
 	if stencilFolder != "" {
 		fileList, err := ioutil.ReadDir(stencilFolder)
@@ -241,11 +310,24 @@ func runRenderStencil(c *cli.Context) {
 			printFatal("Failed to fetch all files from folder %s: %s", stencilFolder, err.Error())
 		}
 		for _, file := range fileList {
-			if file.Name() == ".pause" {
+			filePath := filepath.Join(stencilFolder, file.Name())
+			ignored, err := ignoreMatcher.isIgnored(filePath)
+			if err != nil {
+				printFatal("Invalid .cxignore pattern: %s", err.Error())
+			}
+			if ignored {
 				continue
 			}
 
-			filesToRender = append(filesToRender, filepath.Join(stencilFolder, file.Name()))
+			matched, err := stencilIncluded(includes, excludes, file.Name())
+			if err != nil {
+				printFatal("Invalid --include/--exclude pattern: %s", err.Error())
+			}
+			if !matched {
+				continue
+			}
+
+			filesToRender = append(filesToRender, filePath)
 		}
 	} else {
 		filesToRender = append(filesToRender, stencilFilename)
@@ -266,6 +348,33 @@ func runRenderStencil(c *cli.Context) {
 		snapshotUID = snapshotIDParam
 	}
 
+	diffTarget := c.String("diff")
+	diffContextLines := c.Int("diff-context")
+	if diffContextLines <= 0 {
+		diffContextLines = 3
+	}
+
+	var diffSnapshotUID string
+	if diffTarget == "previous" {
+		snapshots, err := client.Snapshots(stack.Uid)
+		must(err)
+		sort.Sort(snapshotsByDate(snapshots))
+
+		idx := -1
+		for i, s := range snapshots {
+			if s.Uid == snapshotUID {
+				idx = i
+				break
+			}
+		}
+		if idx == -1 || idx+1 >= len(snapshots) {
+			printFatal("No snapshot found before %s", snapshotUID)
+		}
+		diffSnapshotUID = snapshots[idx+1].Uid
+	} else if diffTarget != "" {
+		diffSnapshotUID = diffTarget
+	}
+
 	formation, err := loadFormation(stack, formationName)
 	must(err)
 
@@ -292,7 +401,7 @@ func runRenderStencil(c *cli.Context) {
 		}
 
 		// output filename is sequenced if provided. otherwise, it's concatenated
-		renderStencil(stencil, formation, stack, output, snapshotUID, ignoreWarnings, ignoreErrors)
+		renderStencil(stencil, formation, stack, output, snapshotUID, ignoreWarnings, ignoreErrors, postProcessors, diffSnapshotUID, diffContextLines, jsonMode)
 	}
 
 	if watch {
@@ -315,6 +424,55 @@ func runRenderStencil(c *cli.Context) {
 			fmt.Println("Watching for changes...")
 		}
 
+		// pending holds the last time a path was touched, and renderStencil is only
+		// called for it once no further Write/Create event has arrived within `debounce`
+		var pendingMutex sync.Mutex
+		pending := make(map[string]time.Time)
+
+		markPending := func(path string) {
+			pendingMutex.Lock()
+			pending[path] = time.Now()
+			pendingMutex.Unlock()
+		}
+
+		// formation is reloaded by the event-handling goroutine below whenever a new
+		// stencil file appears, and read by the debounce-ticker goroutine to render
+		// pending paths - formationMutex guards it against concurrent access
+		var formationMutex sync.Mutex
+		currentFormation := func() *cloud66.Formation {
+			formationMutex.Lock()
+			defer formationMutex.Unlock()
+			return formation
+		}
+
+		go func() {
+			tick := debounce / 4
+			if tick <= 0 {
+				tick = 50 * time.Millisecond
+			}
+			ticker := time.NewTicker(tick)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				var ready []string
+				now := time.Now()
+
+				pendingMutex.Lock()
+				for path, lastSeen := range pending {
+					if now.Sub(lastSeen) >= debounce {
+						ready = append(ready, path)
+						delete(pending, path)
+					}
+				}
+				pendingMutex.Unlock()
+
+				for _, path := range ready {
+					renderOutput := getRenderFilepath(outdir, filepath.Base(path))
+					renderStencil(path, currentFormation(), stack, renderOutput, snapshotUID, ignoreWarnings, ignoreErrors, postProcessors, "", 0, jsonMode)
+				}
+			}
+		}()
+
 		go func() {
 			for {
 				select {
@@ -329,17 +487,33 @@ func runRenderStencil(c *cli.Context) {
 							fmt.Fprintln(os.Stderr, "Resuming watch...")
 							paused = false
 						}
+
+						// stop watching removed directories, in case they come back as a file later
+						watcher.Remove(event.Name)
 					}
 
 					if paused {
 						continue
 					}
 
+					if filepath.Base(event.Name) == ".cxignore" && (event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create) {
+						fmt.Fprintf(os.Stderr, "%s changed. Reloading ignore rules\n", event.Name)
+						if reloaded, err := loadCxIgnore(stencilFolder); err != nil {
+							fmt.Fprintf(os.Stderr, ansi.Color(fmt.Sprintf("Failed to reload .cxignore: %s\n", err.Error()), "yellow"))
+						} else {
+							ignoreMatcher = reloaded
+						}
+						continue
+					}
+
 					if event.Op&fsnotify.Write == fsnotify.Write {
-						// file modified
-						changedFile := filepath.Base(event.Name)
-						output = getRenderFilepath(outdir, changedFile)
-						renderStencil(event.Name, formation, stack, output, snapshotUID, ignoreWarnings, ignoreErrors)
+						if info, err := os.Stat(event.Name); err == nil && !info.IsDir() {
+							if ignored, err := ignoreMatcher.isIgnored(event.Name); err == nil && !ignored {
+								if matched, err := stencilIncluded(includes, excludes, stencilRelPath(stencilFolder, event.Name)); err == nil && matched {
+									markPending(event.Name)
+								}
+							}
+						}
 					}
 					if event.Op&fsnotify.Create == fsnotify.Create {
 						if filepath.Base(event.Name) == ".pause" {
@@ -348,18 +522,32 @@ func runRenderStencil(c *cli.Context) {
 							continue
 						}
 
-						// new file added
-						newFile := filepath.Base(event.Name)
-						output = getRenderFilepath(outdir, newFile)
+						if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+							// new subdirectory. watch it and anything nested inside it
+							fmt.Fprintf(os.Stderr, "New directory %s found. Watching it\n", event.Name)
+							if err := addWatchesRecursive(watcher, event.Name); err != nil {
+								fmt.Fprintf(os.Stderr, ansi.Color(fmt.Sprintf("Failed to watch %s: %s\n", event.Name, err.Error()), "yellow"))
+							}
+							continue
+						}
 
-						fmt.Fprintf(os.Stderr, "New file %s found. Reloading stencil list\n", newFile)
+						if ignored, err := ignoreMatcher.isIgnored(event.Name); err == nil && ignored {
+							continue
+						}
 
-						// we're going to wait for a few seconds before rendering
-						time.Sleep(10 * time.Second)
-						formation, _ = loadFormation(stack, formation.Name)
+						matched, err := stencilIncluded(includes, excludes, stencilRelPath(stencilFolder, event.Name))
+						if err != nil || !matched {
+							continue
+						}
 
-						renderStencil(event.Name, formation, stack, output, snapshotUID, ignoreWarnings, ignoreErrors)
-						watcher.Add(event.Name)
+						// new file added
+						fmt.Fprintf(os.Stderr, "New file %s found. Reloading stencil list\n", filepath.Base(event.Name))
+						if reloaded, err := loadFormation(stack, currentFormation().Name); err == nil {
+							formationMutex.Lock()
+							formation = reloaded
+							formationMutex.Unlock()
+						}
+						markPending(event.Name)
 					}
 				case err, ok := <-watcher.Errors:
 					if !ok {
@@ -377,13 +565,28 @@ func runRenderStencil(c *cli.Context) {
 			}
 		}
 		if stencilFolder != "" {
-			watcher.Add(stencilFolder)
+			if err := addWatchesRecursive(watcher, stencilFolder); err != nil {
+				printFatal("Failed to setup a recursive watch for %s: %s", stencilFolder, err.Error())
+			}
 		}
 
 		<-done
 	}
 }
 
+// addWatchesRecursive walks the folder tree rooted at dir and adds every directory it finds to the watcher
+func addWatchesRecursive(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}
+
 func defaultOutputFolder(formationName string) (string, error) {
 	dir := filepath.Join(homePath(), "cloud66", "formations", formationName, "renders")
 	err := os.MkdirAll(dir, os.ModePerm)
@@ -437,7 +640,11 @@ func renderStencil(stencilFilename string,
 	output string,
 	snapshotUID string,
 	ignoreWarnings bool,
-	ignoreErrors bool) {
+	ignoreErrors bool,
+	postProcessors []string,
+	diffSnapshotUID string,
+	diffContextLines int,
+	jsonMode bool) {
 
 	if does, _ := fileExists(stencilFilename); !does {
 		printFatal("Cannot find %s", stencilFilename)
@@ -479,23 +686,15 @@ func renderStencil(stencilFilename string,
 		return
 	}
 
-	// check the checksum
-	if output != "" {
-		checksum := generateChecksum(body)
-		readChecksum, err := readMagicComment(output, "checksum")
-
-		if err != nil {
-			// ignore the error and carry on
-			fmt.Fprintf(os.Stderr, ansi.Color(fmt.Sprintf("Failed to read the checksum: %s\n", err.Error()), "yellow"))
+	// the checksum written alongside the output is of the post-processed
+	// content, so it can only be compared once the content's been rendered
+	// and post-processed - the skip check below happens there instead.
+	if output != "" && diffSnapshotUID == "" {
+		if jsonMode {
+			fmt.Fprintf(os.Stderr, "[%s] Rendering %s to %s\n", formation.Name, stencilFilename, output)
 		} else {
-			if checksum == readChecksum {
-				// they are equal. skip
-				fmt.Fprintf(os.Stdout, fmt.Sprintf("No change found in %s\n", output))
-				return
-			}
+			fmt.Printf("[%s] Rendering %s to %s\n", formation.Name, stencilFilename, output)
 		}
-
-		fmt.Printf("[%s] Rendering %s to %s\n", formation.Name, stencilFilename, output)
 	}
 
 	var renders *cloud66.Renders
@@ -503,6 +702,10 @@ func renderStencil(stencilFilename string,
 	must(err)
 
 	foundErrors := renders.Errors()
+	errorStrs := make([]string, 0, len(foundErrors))
+	for _, renderError := range foundErrors {
+		errorStrs = append(errorStrs, fmt.Sprintf("%s in %s", renderError.Text, renderError.Stencil))
+	}
 	if len(foundErrors) != 0 {
 		fmt.Fprintln(os.Stderr, ansi.Color("Error during rendering of stencils:", "red+h"))
 		for _, renderError := range foundErrors {
@@ -510,11 +713,18 @@ func renderStencil(stencilFilename string,
 		}
 
 		if !ignoreErrors {
+			if jsonMode {
+				printRenderResultJSON(stencilRenderJSON{Source: stencilFilename, OutputPath: output, Errors: errorStrs})
+			}
 			return
 		}
 	}
 
 	foundWarnings := renders.Warnings()
+	warningStrs := make([]string, 0, len(foundWarnings))
+	for _, renderWarning := range foundWarnings {
+		warningStrs = append(warningStrs, fmt.Sprintf("%s in %s", renderWarning.Text, renderWarning.Stencil))
+	}
 	if len(foundWarnings) != 0 {
 		fmt.Fprintln(os.Stderr, ansi.Color("Warning during rendering of stencils:", "yellow"))
 		for _, renderError := range foundWarnings {
@@ -522,25 +732,105 @@ func renderStencil(stencilFilename string,
 		}
 
 		if !ignoreWarnings {
+			if jsonMode {
+				printRenderResultJSON(stencilRenderJSON{Source: stencilFilename, OutputPath: output, Warnings: warningStrs, Errors: errorStrs})
+			}
 			return
 		}
 	}
 
+	if diffSnapshotUID != "" {
+		diffRenders, err := client.RenderStencil(stack.Uid, diffSnapshotUID, formation.Uid, stencilUID, body)
+		must(err)
+
+		for i, v := range renders.Stencils {
+			var diffContent string
+			if i < len(diffRenders.Stencils) {
+				diffContent = diffRenders.Stencils[i].Content
+			}
+
+			primary, err := applyPostProcessors(postProcessors, []byte(v.Content))
+			if err != nil && !ignoreErrors {
+				fmt.Fprintln(os.Stderr, ansi.Color(fmt.Sprintf("Error during post-processing of %s: %s", stencilFilename, err.Error()), "red+h"))
+				return
+			}
+			secondary, err := applyPostProcessors(postProcessors, []byte(diffContent))
+			if err != nil && !ignoreErrors {
+				fmt.Fprintln(os.Stderr, ansi.Color(fmt.Sprintf("Error during post-processing of %s: %s", stencilFilename, err.Error()), "red+h"))
+				return
+			}
+
+			diffText, err := unifiedStencilDiff(stencilFilename, diffSnapshotUID, snapshotUID, secondary, primary, diffContextLines)
+			if err != nil {
+				printFatal("Failed to diff %s: %s", stencilFilename, err.Error())
+			}
+
+			if output != "" {
+				err = ioutil.WriteFile(output+".diff", []byte(diffText), 0644)
+				if err != nil {
+					printFatal(err.Error())
+				}
+			} else {
+				fmt.Print(diffText)
+			}
+		}
+
+		return
+	}
+
 	// content
 	for _, v := range renders.Stencils {
-		content := v.Content
-		// add magic content
-		checksum := generateChecksum(body)
-		content = fmt.Sprintf("# cx.checksum: %s\n%s", checksum, content)
+		processed, err := applyPostProcessors(postProcessors, []byte(v.Content))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, ansi.Color(fmt.Sprintf("Error during post-processing of %s: %s", stencilFilename, err.Error()), "red+h"))
+			if !ignoreErrors {
+				if jsonMode {
+					printRenderResultJSON(stencilRenderJSON{Source: stencilFilename, OutputPath: output, Warnings: warningStrs, Errors: append(errorStrs, err.Error())})
+				}
+				return
+			}
+		}
+
+		content := string(processed)
+		// add magic content, based on the post-processed output so it reflects what's actually written
+		checksum := generateChecksum(processed)
+
+		if output != "" && diffSnapshotUID == "" {
+			if readChecksum, err := readMagicComment(output, "checksum"); err != nil {
+				// ignore the error and carry on
+				fmt.Fprintf(os.Stderr, ansi.Color(fmt.Sprintf("Failed to read the checksum: %s\n", err.Error()), "yellow"))
+			} else if checksum == readChecksum {
+				// they are equal. skip
+				if jsonMode {
+					fmt.Fprintf(os.Stderr, "No change found in %s\n", output)
+				} else {
+					fmt.Fprintf(os.Stdout, fmt.Sprintf("No change found in %s\n", output))
+				}
+				continue
+			}
+		}
+
+		taggedContent := fmt.Sprintf("# cx.checksum: %s\n%s", checksum, content)
 		// to a file
 		if output != "" {
-			err = ioutil.WriteFile(output, []byte(content), 0644)
+			err = ioutil.WriteFile(output, []byte(taggedContent), 0644)
 			if err != nil {
 				printFatal(err.Error())
 			}
-		} else {
+		} else if !jsonMode {
 			// concatenate
-			fmt.Printf("%s---\n", content)
+			fmt.Printf("%s---\n", taggedContent)
+		}
+
+		if jsonMode {
+			printRenderResultJSON(stencilRenderJSON{
+				Source:     stencilFilename,
+				OutputPath: output,
+				Checksum:   checksum,
+				Warnings:   warningStrs,
+				Errors:     errorStrs,
+				Content:    content,
+			})
 		}
 	}
 }
@@ -558,6 +848,8 @@ func runShowStencil(c *cli.Context) {
 		printFatal("No stencil name provided. Please use --stencil to specify a stencil")
 	}
 
+	jsonMode := c.Bool("json")
+
 	var formations []cloud66.Formation
 	var err error
 	formations, err = client.Formations(stack.Uid, true)
@@ -569,7 +861,11 @@ func runShowStencil(c *cli.Context) {
 		if formation.Name == formationName {
 			for _, stencil := range formation.Stencils {
 				if stencil.Filename == stencilName {
-					printStencil(stencil)
+					if jsonMode {
+						printStencilJSON(stencil)
+					} else {
+						printStencil(stencil)
+					}
 					foundStencil = true
 				}
 			}
@@ -612,8 +908,18 @@ func runAddStencil(c *cli.Context) {
 		tags = strings.Split(tagList, ",")
 	}
 
+	includes := splitCSVList(c.String("include"))
+	excludes := splitCSVList(c.String("exclude"))
+	matched, err := stencilIncluded(includes, excludes, filepath.Base(stencilFile))
+	if err != nil {
+		printFatal("Invalid --include/--exclude pattern: %s", err.Error())
+	}
+	if !matched {
+		fmt.Printf("Stencil %s excluded by --include/--exclude filters. Skipping\n", stencilFile)
+		return
+	}
+
 	var formations []cloud66.Formation
-	var err error
 	formations, err = client.Formations(stack.Uid, true)
 	must(err)
 	var foundFormation cloud66.Formation
@@ -659,6 +965,11 @@ func printStencils(w io.Writer, formation cloud66.Formation, output string) {
 	stencils := formation.Stencils
 	sort.Sort(stencilBySequence(stencils))
 
+	if output == "json" {
+		printStencilsJSON(stencils)
+		return
+	}
+
 	if output == "standard" {
 		listRec(w,
 			"UID",
@@ -5,23 +5,25 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"text/tabwriter"
 	"time"
 
 	"github.com/cloud66-oss/cloud66"
-	"github.com/cloud66-oss/trackman/notifiers"
 	trackmanType "github.com/cloud66-oss/trackman/utils"
 	"github.com/cloud66/cli"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 	"gopkg.in/go-yaml/yaml.v2"
 )
 
@@ -96,6 +98,10 @@ $ cx formations list -s mystack foo bar // only show formations foo and bar
 					Name:  "overwrite",
 					Usage: "Overwrite existing files in outdir if present. Default is false and asks for overwrite permissions per file",
 				},
+				cli.IntFlag{
+					Name:  "concurrency",
+					Usage: "number of stencils to fetch in parallel. Defaults to runtime.NumCPU()-1",
+				},
 			},
 		},
 		{
@@ -123,6 +129,18 @@ $ cx formations list -s mystack foo bar // only show formations foo and bar
 					Name:  "message",
 					Usage: "Commit message",
 				},
+				cli.IntFlag{
+					Name:  "concurrency",
+					Usage: "number of stencils to commit in parallel. Defaults to runtime.NumCPU()-1",
+				},
+				cli.BoolFlag{
+					Name:  "changed-only",
+					Usage: "Only commit stencils whose content changed since the last fetch, using the directory's manifest. Requires --dir or --default-folders",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "With --changed-only, commit even if the formation has moved upstream since the last fetch",
+				},
 			},
 		},
 		{
@@ -150,6 +168,41 @@ $ cx formations list -s mystack foo bar // only show formations foo and bar
 					Name:  "log-level",
 					Usage: "[OPTIONAL, DEFAULT: info] log level. Use debug to see process output",
 				},
+				cli.StringFlag{
+					Name:  "from-snapshot",
+					Usage: "[OPTIONAL] load the workflow and stencils from a snapshot file created by 'cx formations snapshot' instead of contacting the server",
+				},
+				cli.StringFlag{
+					Name:  "notifier",
+					Usage: "[OPTIONAL, DEFAULT: console] comma separated list of step notifiers: console, json, file:<path>, webhook:<url>",
+				},
+			},
+		},
+		{
+			Name:   "snapshot",
+			Action: runSnapshotFormation,
+			Usage:  "Capture a formation and its workflow into a self-contained snapshot file for offline/air-gapped deploys",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "formation,f",
+					Usage: "the formation name",
+				},
+				cli.StringFlag{
+					Name:  "snapshot-uid",
+					Usage: "[OPTIONAL, DEFAULT: latest] UID of the snapshot to be used. Use 'latest' to use the most recent snapshot",
+				},
+				cli.BoolTFlag{
+					Name:  "use-latest",
+					Usage: "[OPTIONAL, DEFAULT: true] use the snapshot's HEAD gitref (and not the ref stored in the for stencil)",
+				},
+				cli.StringFlag{
+					Name:  "workflow,w",
+					Usage: "[OPTIONAL] name of the workflow to capture",
+				},
+				cli.StringFlag{
+					Name:  "file",
+					Usage: "filename for the snapshot file. Defaults to <formation>.snapshot.json",
+				},
 			},
 		},
 		{
@@ -177,6 +230,18 @@ $ cx formations list -s mystack foo bar // only show formations foo and bar
 							Name:  "overwrite",
 							Usage: "overwrite existing bundle file is it exists",
 						},
+						cli.StringFlag{
+							Name:  "compression",
+							Usage: "[OPTIONAL, DEFAULT: zstd] bundle compression: none, gzip or zstd",
+						},
+						cli.StringFlag{
+							Name:  "encrypt-with",
+							Usage: "[OPTIONAL] encrypt ConfigStore record values before writing them to the bundle: sops",
+						},
+						cli.StringFlag{
+							Name:  "sops-recipients",
+							Usage: "[OPTIONAL] comma separated age recipients to pass to sops --encrypt when --encrypt-with=sops",
+						},
 					},
 				},
 				{
@@ -200,6 +265,45 @@ $ cx formations list -s mystack foo bar // only show formations foo and bar
 							Name:  "message",
 							Usage: "Commit message",
 						},
+						cli.StringFlag{
+							Name:  "compression",
+							Usage: "[OPTIONAL] fail unless the bundle file is compressed with this algorithm: none, gzip or zstd. By default whatever the bundle carries is accepted",
+						},
+						cli.StringFlag{
+							Name:  "output",
+							Usage: "[OPTIONAL, DEFAULT: plaintext] how to report the upload outcome: plaintext, json or yaml",
+						},
+						cli.BoolFlag{
+							Name:  "silent",
+							Usage: "[OPTIONAL] suppress all progress output, including progress bars",
+						},
+						cli.BoolFlag{
+							Name:  "no-progress",
+							Usage: "[OPTIONAL] replace the per-section progress bars with plain one-line status messages",
+						},
+						cli.IntFlag{
+							Name:  "concurrency",
+							Usage: "[OPTIONAL, DEFAULT: 4] number of bundle sections and records to upload in parallel",
+						},
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "[OPTIONAL] don't create or change anything - print a diff of what the upload would do, classifying every item as added, changed, unchanged or would-skip-duplicate",
+						},
+						cli.StringFlag{
+							Name:  "conflict",
+							Usage: "[OPTIONAL, DEFAULT: skip] what to do when a stencil, policy, transformation, helm release, workflow, env var or ConfigStore record already exists: skip, overwrite, or fail",
+						},
+					},
+				},
+				{
+					Name:   "verify",
+					Action: runBundleVerify,
+					Usage:  "Verify the integrity of a formation bundle",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "file",
+							Usage: "filename for the bundle file to verify",
+						},
 					},
 				},
 			},
@@ -321,6 +425,9 @@ func runCommitFormation(c *cli.Context) {
 			printFatal("Cannot fetch file list in %s: %s", dir, err.Error())
 		}
 		for _, file := range fileList {
+			if file.Name() == formationManifestFilename {
+				continue
+			}
 			filesToSave = append(filesToSave, filepath.Join(dir, file.Name()))
 		}
 	} else {
@@ -333,32 +440,83 @@ func runCommitFormation(c *cli.Context) {
 		}
 	}
 
-	for _, stencilFile := range filesToSave {
-		stencilName := filepath.Base(stencilFile)
-		stencil := formation.FindStencil(stencilName)
-		if stencil == nil {
-			printFatal("No stencil named %s found on the formation", stencilName)
+	if c.Bool("changed-only") {
+		if dir == "" {
+			printFatal("--changed-only requires --dir or --default-folders")
+		}
+
+		manifest, err := loadFormationManifest(dir)
+		if err != nil {
+			printFatal("Failed to load formation manifest: %s", err.Error())
 		}
 
+		if !c.Bool("force") {
+			if err := checkFormationDrift(formation, manifest); err != nil {
+				printFatal("%s (use --force to commit anyway)", err.Error())
+			}
+		}
+
+		filesToSave, err = filterChangedStencils(filesToSave, manifest)
+		if err != nil {
+			printFatal(err.Error())
+		}
+
+		if len(filesToSave) == 0 {
+			fmt.Println("Nothing changed since the last fetch")
+			return
+		}
+	}
+
+	concurrency := c.Int("concurrency")
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU() - 1
+	}
+
+	// read every file up front and flag anything that looks like a rendered
+	// stencil, so the user is asked about all of them once, rather than
+	// being interrupted mid-batch once uploads are already under way
+	bodies := make([][]byte, len(filesToSave))
+	flagged := make([]string, 0)
+	for i, stencilFile := range filesToSave {
 		body, err := ioutil.ReadFile(stencilFile)
 		if err != nil {
-			printFatal("Failed to read %s: %s", stencilName, err.Error())
+			printFatal("Failed to read %s: %s", stencilFile, err.Error())
 		}
+		bodies[i] = body
+
 		// check to make it we're not pushing rendered files by mistake
 		checksum, _ := readMagicComment(stencilFile, "checksum")
 		if checksum != "NO_MATCH" {
-			if !ask(fmt.Sprintf("Stencil %s contains a checksum which suggests it might be a rendered stencil. Are you sure you are committing the right file? (y/N)", stencilFile), "y") {
-				fmt.Println("Exiting")
-				os.Exit(0)
-			}
+			flagged = append(flagged, stencilFile)
 		}
+	}
 
-		_, err = client.UpdateStencil(stack.Uid, formation.Uid, stencil.Uid, message, body)
-		if err != nil {
-			printFatal("Failed to commit %s: %s", stencilFile, err.Error())
+	if len(flagged) > 0 {
+		fmt.Println("The following files contain a checksum, which suggests they might be rendered stencils:")
+		for _, file := range flagged {
+			fmt.Printf("  %s\n", file)
+		}
+		if !ask("Are you sure you are committing the right files? (y/N)", "y") {
+			fmt.Println("Exiting")
+			os.Exit(0)
+		}
+	}
+
+	err = runStencilPool(filesToSave, concurrency, func(idx int, stencilFile string) (string, error) {
+		stencilName := filepath.Base(stencilFile)
+		stencil := formation.FindStencil(stencilName)
+		if stencil == nil {
+			return "", fmt.Errorf("no stencil named %s found on the formation", stencilName)
+		}
+
+		if _, err := client.UpdateStencil(stack.Uid, formation.Uid, stencil.Uid, message, bodies[idx]); err != nil {
+			return "", err
 		}
 
-		fmt.Printf("Saved %s\n", stencilName)
+		return fmt.Sprintf("Saved %s", stencilName), nil
+	})
+	if err != nil {
+		printFatal(err.Error())
 	}
 
 	fmt.Println("Done")
@@ -411,8 +569,16 @@ func runFetchFormation(c *cli.Context) {
 
 	overwrite := c.Bool("overwrite")
 
+	// decide what to write up front, since the overwrite prompt is
+	// interactive and has to stay serial even though the writes themselves
+	// don't
+	type fetchJob struct {
+		stencil cloud66.Stencil
+		path    string
+	}
+
+	jobs := make([]fetchJob, 0, len(formation.Stencils))
 	for _, stencil := range formation.Stencils {
-		body := []byte(stencil.Body)
 		write := false
 		stencilFile := filepath.Join(stencilDir, stencil.Filename)
 		if does, _ := fileExists(stencilFile); does {
@@ -427,43 +593,101 @@ func runFetchFormation(c *cli.Context) {
 		}
 
 		if write {
-			if err := ioutil.WriteFile(stencilFile, body, 0644); err != nil {
-				printFatal("Writing %s to %s failed: %s", stencil.Filename, stencilDir, err.Error())
-			}
+			jobs = append(jobs, fetchJob{stencil: stencil, path: stencilFile})
 		}
 	}
 
+	concurrency := c.Int("concurrency")
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU() - 1
+	}
+
+	files := make([]string, len(jobs))
+	for i, job := range jobs {
+		files[i] = job.path
+	}
+
+	err = runStencilPool(files, concurrency, func(idx int, path string) (string, error) {
+		job := jobs[idx]
+		if err := ioutil.WriteFile(path, []byte(job.stencil.Body), 0644); err != nil {
+			return "", fmt.Errorf("writing %s to %s failed: %s", job.stencil.Filename, stencilDir, err.Error())
+		}
+		return "", nil
+	})
+	if err != nil {
+		printFatal(err.Error())
+	}
+
+	if err := writeFormationManifest(stencilDir, formationManifestEntries(formation, stencilDir)); err != nil {
+		printFatal("Failed to write formation manifest: %s", err.Error())
+	}
+
 	fmt.Printf("\nFormation is available at %s\n", stencilDir)
 }
 
-func runDeployFormation(c *cli.Context) {
-	stack := mustStack(c)
+// formationManifestEntries builds one manifest entry per stencil in
+// formation: SHA256 is the hash of whatever is now on disk for that stencil
+// (which, for a file skipped during this fetch, may predate it), and ETag is
+// the hash of the body the server just returned, so a later commit can tell
+// both "did I edit this locally" and "did the server move since I fetched".
+func formationManifestEntries(formation *cloud66.Formation, stencilDir string) []formationManifestEntry {
+	entries := make([]formationManifestEntry, 0, len(formation.Stencils))
+	for _, stencil := range formation.Stencils {
+		sha := digestString(stencil.Body)
+		if onDisk, err := sha256File(filepath.Join(stencilDir, stencil.Filename)); err == nil {
+			sha = onDisk
+		}
 
-	formationName := getArgument(c, "formation")
-	if formationName == "" {
-		printFatal("No formation provided. Please use --formation to specify a formation")
+		entries = append(entries, formationManifestEntry{
+			Filename:   stencil.Filename,
+			SHA256:     sha,
+			StencilUID: stencil.Uid,
+			ETag:       digestString(stencil.Body),
+		})
 	}
+	return entries
+}
+
+func runDeployFormation(c *cli.Context) {
+	stack := mustStack(c)
 
 	var formation *cloud66.Formation
-	formations, err := client.Formations(stack.Uid, true)
-	must(err)
-	for _, innerFormation := range formations {
-		if innerFormation.Name == formationName {
-			formation = &innerFormation
-			break
+	var workflowBody []byte
+
+	if snapshotFile := c.String("from-snapshot"); snapshotFile != "" {
+		fmt.Printf("Deploying from snapshot %s\n", snapshotFile)
+		formation, workflowBody = loadFormationSnapshot(snapshotFile)
+	} else {
+		formationName := getArgument(c, "formation")
+		if formationName == "" {
+			printFatal("No formation provided. Please use --formation to specify a formation")
 		}
-	}
-	if formation == nil {
-		printFatal("Formation with name \"%v\" could not be found", formationName)
-	}
 
-	snapshotUID := c.String("snapshot-uid")
-	if snapshotUID == "" {
-		snapshotUID = "latest"
-	}
+		formations, err := client.Formations(stack.Uid, true)
+		must(err)
+		for _, innerFormation := range formations {
+			if innerFormation.Name == formationName {
+				formation = &innerFormation
+				break
+			}
+		}
+		if formation == nil {
+			printFatal("Formation with name \"%v\" could not be found", formationName)
+		}
 
-	// use HEAD stencil instead of the version in in the snapshot
-	useLatest := c.BoolT("use-latest")
+		snapshotUID := c.String("snapshot-uid")
+		if snapshotUID == "" {
+			snapshotUID = "latest"
+		}
+
+		// use HEAD stencil instead of the version in in the snapshot
+		useLatest := c.BoolT("use-latest")
+
+		workflowName := getArgument(c, "workflow")
+		workflowWrapper, err := client.GetWorkflow(stack.Uid, formation.Uid, snapshotUID, useLatest, workflowName)
+		must(err)
+		workflowBody = workflowWrapper.Workflow
+	}
 
 	level := logrus.InfoLevel
 	logLevel := c.String("log-level")
@@ -474,16 +698,17 @@ func runDeployFormation(c *cli.Context) {
 		level = logrus.DebugLevel
 	}
 
-	workflowName := getArgument(c, "workflow")
-	workflowWrapper, err := client.GetWorkflow(stack.Uid, formation.Uid, snapshotUID, useLatest, workflowName)
-	must(err)
+	notifier, err := formationNotifierFromFlag(c.String("notifier"))
+	if err != nil {
+		printFatal(err.Error())
+	}
 
 	ctx := context.Background()
 	ctx = context.WithValue(ctx, trackmanType.CtxLogLevel, level)
 
-	reader := bytes.NewReader(workflowWrapper.Workflow)
+	reader := bytes.NewReader(workflowBody)
 	options := &trackmanType.WorkflowOptions{
-		Notifier:    notifiers.ConsoleNotify,
+		Notifier:    notifier,
 		Concurrency: runtime.NumCPU() - 1,
 		Timeout:     10 * time.Minute,
 	}
@@ -524,7 +749,12 @@ func runBundleDownload(c *cli.Context) {
 			printFatal("%s already exists", bundleFile)
 		}
 	}
-	var err error
+
+	compression, err := parseBundleCompressionFlag(c.String("compression"))
+	if err != nil {
+		printFatal(err.Error())
+	}
+
 	var envVars []cloud66.StackEnvVar
 	envVars, err = client.StackEnvVars(stack.Uid)
 	must(err)
@@ -543,7 +773,7 @@ func runBundleDownload(c *cli.Context) {
 			bundledConfigStoreRecords, err := downloadBundledConfigStoreRecords(account, stack, &formation)
 			must(err)
 
-			bundleFormation(&formation, bundleFile, envVars, bundledConfigStoreRecords)
+			bundleFormation(&formation, bundleFile, envVars, bundledConfigStoreRecords, compression, c.String("encrypt-with"), c.String("sops-recipients"))
 			return
 		}
 	}
@@ -574,44 +804,138 @@ func runBundleUpload(c *cli.Context) {
 		printFatal(err.Error())
 	}
 
-	err = Untar(bundleFile, bundleTopPath)
+	detectedCompression, err := untarBundle(bundleFile, bundleTopPath)
 	if err != nil {
 		printFatal(err.Error())
 	}
 	bundlePath := filepath.Join(bundleTopPath, "bundle")
 	manifestFile := filepath.Join(bundlePath, "manifest.json")
-	message := c.String("message")
-	if message == "" {
-		printFatal("No message given. Use --message to provide a message for the commit")
+
+	if wanted := c.String("compression"); wanted != "" {
+		if _, err := parseBundleCompressionFlag(wanted); err != nil {
+			printFatal(err.Error())
+		}
+		if wanted != detectedCompression {
+			printFatal("Bundle %s is %s-compressed, not %s", bundleFile, detectedCompression, wanted)
+		}
 	}
 
+	outputFormat := c.String("output")
+
 	// load the bundle manifest
 	fb := loadFormationBundle(manifestFile)
 
+	// verify the integrity of the bundle contents, if it carries a content-addressed index
+	err = verifyBundleIntegrity(bundlePath)
+	if err != nil {
+		printFatal(err.Error())
+	}
+
 	// verify the presence of the BTRs
 	err = verifyBtrPresence(fb)
 	if err != nil {
 		printFatal(err.Error())
 	}
 
-	// create the formation and populate it with the stencils and policies
-	formation, err := createAndUploadFormations(fb, formationName, stack, bundlePath, message)
+	if c.Bool("dry-run") {
+		result, err := diffBundleUpload(fb, account, stack, formationName, bundlePath)
+		if err != nil {
+			printFatal(err.Error())
+		}
+		if err := printBundleDiffResult(result, outputFormat); err != nil {
+			printFatal(err.Error())
+		}
+		return
+	}
+
+	message := c.String("message")
+	if message == "" {
+		printFatal("No message given. Use --message to provide a message for the commit")
+	}
+
+	conflictPolicy, err := parseBundleConflictFlag(c.String("conflict"))
 	if err != nil {
 		printFatal(err.Error())
 	}
 
-	// add the environment variables
-	err = uploadEnvironmentVariables(fb, formation, stack, bundlePath)
+	progress := newBundleUploadProgress(c.Bool("silent"), c.Bool("no-progress"))
+
+	concurrency := c.Int("concurrency")
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		fmt.Println("\nReceived interrupt, finishing in-flight sections and stopping...")
+		cancel()
+	}()
+	defer signal.Stop(sig)
+
+	// create the formation, then populate it with the stencils, policies,
+	// transformations, helm releases, workflows, env vars and ConfigStore
+	// records, all of which upload concurrently, bounded by --concurrency
+	formation, err := createFormation(fb, formationName, stack)
 	if err != nil {
 		printFatal(err.Error())
 	}
 
-	fmt.Println("Adding ConfigStore records")
-	err = handleBundleUploadConfigStoreRecords(fb, account, stack, formation, bundlePath)
+	result := uploadBundleSections(ctx, concurrency, conflictPolicy, progress, fb, account, stack, formation, bundlePath, message)
+
+	if err := printBundleUploadResult(result, outputFormat); err != nil {
+		printFatal(err.Error())
+	}
+
+	if ctx.Err() != nil {
+		printFatal("bundle upload interrupted - the formation and every entry reported above as success was uploaded. Re-run the same command to pick up where it left off")
+	}
+
+	if result.HasCriticalErrors(conflictPolicy) {
+		printFatal("bundle upload finished with errors:\n%s", result.Err().Error())
+	}
+}
+
+func runBundleVerify(c *cli.Context) {
+	bundleFile := c.String("file")
+	if bundleFile == "" {
+		printFatal("No bundle file provided. Please use --file to specify a formation bundle")
+	}
+
+	bundleTopPath, err := ioutil.TempDir("", "formation-bundle-verify-")
 	if err != nil {
 		printFatal(err.Error())
 	}
-	fmt.Println("Added ConfigStore records")
+	defer os.RemoveAll(bundleTopPath)
+
+	detectedCompression, err := untarBundle(bundleFile, bundleTopPath)
+	if err != nil {
+		printFatal(err.Error())
+	}
+	bundlePath := filepath.Join(bundleTopPath, "bundle")
+
+	if recorded, err := loadBundleManifestCompression(filepath.Join(bundlePath, "manifest.json")); err == nil && recorded != "" && recorded != detectedCompression {
+		printFatal("manifest.json says this bundle is %s-compressed, but it is actually %s", recorded, detectedCompression)
+	}
+	fmt.Printf("Compression: %s\n", detectedCompression)
+
+	index, err := loadPackIndex(bundlePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			printFatal("%s has no content-addressed index to verify (it predates packindex.json)", bundleFile)
+		}
+		printFatal(err.Error())
+	}
+
+	fmt.Println("Verifying bundle content integrity...")
+	err = verifyPackIndex(bundlePath, index)
+	if err != nil {
+		printFatal("bundle integrity check failed: %s", err.Error())
+	}
+
+	fmt.Printf("%s is intact\n", bundleFile)
 }
 
 func validateFormationForBundleCreation(formation *cloud66.Formation) error {
@@ -625,7 +949,7 @@ func validateFormationForBundleCreation(formation *cloud66.Formation) error {
 	return nil
 }
 
-func bundleFormation(formation *cloud66.Formation, bundleFile string, envVars []cloud66.StackEnvVar, bundledConfigStoreRecords *cloud66.BundledConfigStoreRecords) {
+func bundleFormation(formation *cloud66.Formation, bundleFile string, envVars []cloud66.StackEnvVar, bundledConfigStoreRecords *cloud66.BundledConfigStoreRecords, compression string, encryptWith string, sopsRecipients string) {
 	// build a temp folder structure
 	topDir, err := ioutil.TempDir("", fmt.Sprintf("%s-formation-bundle-", formation.Name))
 	if err != nil {
@@ -741,9 +1065,20 @@ func bundleFormation(formation *cloud66.Formation, bundleFile string, envVars []
 	configurations := []string{filename}
 
 	fmt.Println("Saving ConfigStore records...")
+	var configStoreValueFromOverlay *configStoreValueFromFile
+	if encryptWith != "" {
+		if encryptWith != "sops" {
+			printFatal("unknown --encrypt-with %q. Supported values are: sops", encryptWith)
+		}
+		fmt.Println("Encrypting ConfigStore record values with sops...")
+		configStoreValueFromOverlay, err = encryptConfigStoreRecordsWithSops(bundledConfigStoreRecords, sopsRecipients)
+		if err != nil {
+			printFatal(err.Error())
+		}
+	}
 	filename = "configstore-records.yml"
 	configstorePath := filepath.Join(configstoreDir, filename)
-	err = saveBundledConfigStoreRecords(bundledConfigStoreRecords, configstorePath)
+	err = saveBundledConfigStoreRecords(bundledConfigStoreRecords, configStoreValueFromOverlay, configstorePath)
 	if err != nil {
 		printFatal(err.Error())
 	}
@@ -765,7 +1100,7 @@ func bundleFormation(formation *cloud66.Formation, bundleFile string, envVars []
 	// create and save the manifest
 	fmt.Println("Saving bundle manifest...")
 	manifest := cloud66.CreateFormationBundle(*formation, fmt.Sprintf("cx (%s)", VERSION), configurations, configstore)
-	buf, err := json.MarshalIndent(manifest, "", "    ")
+	buf, err := marshalBundleManifest(manifest, compression)
 	if err != nil {
 		printFatal(err.Error())
 	}
@@ -780,8 +1115,15 @@ func bundleFormation(formation *cloud66.Formation, bundleFile string, envVars []
 		printFatal(err.Error())
 	}
 
+	// content-addressed index, for integrity verification and dedup on upload
+	fmt.Println("Indexing bundle contents...")
+	err = writeContentAddressedIndex(dir, []string{"stencils", "policies", "transformations", "workflows"})
+	if err != nil {
+		printFatal(err.Error())
+	}
+
 	// tarball
-	err = Tar(dir, bundleFile)
+	err = tarBundle(dir, bundleFile, compression)
 	if err != nil {
 		printFatal(err.Error())
 	}
@@ -906,7 +1248,9 @@ func verifyBtrPresence(fb *cloud66.FormationBundle) error {
 	return nil
 }
 
-func createAndUploadFormations(fb *cloud66.FormationBundle, formationName string, stack *cloud66.Stack, bundlePath string, message string) (*cloud66.Formation, error) {
+// createFormation creates the (initially empty) formation that the rest of
+// the bundle's sections get uploaded into.
+func createFormation(fb *cloud66.FormationBundle, formationName string, stack *cloud66.Stack) (*cloud66.Formation, error) {
 	fmt.Printf("Creating %s formation...\n", formationName)
 
 	baseTemplates := getTemplateList(fb)
@@ -916,186 +1260,525 @@ func createAndUploadFormations(fb *cloud66.FormationBundle, formationName string
 	}
 	fmt.Println("Formation created")
 
+	return formation, nil
+}
+
+// bundleUploadSection is one independent unit of work in the bundle upload
+// pipeline - the stencils from a single BaseTemplate, all policies, all
+// ConfigStore records, and so on. uploadBundleSections runs these bounded by
+// sectionSem rather than one after another, so e.g. a bundle with several
+// BTRs uploads all of their stencils at once instead of serially.
+type bundleUploadSection struct {
+	onFailure string // printed (with the error) if run returns a non-nil error
+	run       func() (*BundleUploadResult, error)
+}
+
+// uploadBundleSections runs every section of a bundle upload concurrently,
+// bounded by sectionSem, and merges their results back in the sections'
+// original order regardless of completion order. Each section fans its own
+// file-parsing phase out further across a second, independently-bounded
+// semaphore - sections and their items are capped at the same --concurrency,
+// but kept on separate semaphores so a section holding its one sectionSem
+// slot can't deadlock waiting on a slot of its own. If a section's batched
+// API call fails outright (as opposed to a handful of its entries failing,
+// which is recorded per-entry and doesn't stop the rest), ctx is cancelled
+// so sections that haven't started their network calls yet stop cleanly
+// instead of piling on more failures.
+func uploadBundleSections(ctx context.Context, concurrency int, conflictPolicy string, progress *bundleUploadProgress, fb *cloud66.FormationBundle, account *cloud66.Account, stack *cloud66.Stack, formation *cloud66.Formation, bundlePath string, message string) *BundleUploadResult {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// each section gets its own bundleUploadProgress rather than sharing the
+	// one passed in: they run concurrently below, and bundleUploadProgress.bar
+	// isn't safe for concurrent start/increment/finish calls
+	sectionProgress := func() *bundleUploadProgress {
+		return newBundleUploadProgress(progress.silent, progress.noProgress)
+	}
+
+	sections := make([]bundleUploadSection, 0, len(fb.BaseTemplates)+5)
 	for _, baseTemplate := range fb.BaseTemplates {
-		// add stencils
-		err = uploadStencils(baseTemplate, formation, stack, bundlePath, message)
-		if err != nil {
-			return nil, err
+		baseTemplate := baseTemplate
+		sections = append(sections, bundleUploadSection{
+			onFailure: fmt.Sprintf("Failed to add stencils from %s", baseTemplate.Name),
+			run: func() (*BundleUploadResult, error) {
+				return uploadStencils(concurrency, conflictPolicy, sectionProgress(), baseTemplate, formation, stack, bundlePath, message)
+			},
+		})
+	}
+	sections = append(sections,
+		bundleUploadSection{
+			onFailure: "Failed to add policies",
+			run: func() (*BundleUploadResult, error) {
+				return uploadPolicies(concurrency, conflictPolicy, sectionProgress(), fb, formation, stack, bundlePath, message)
+			},
+		},
+		bundleUploadSection{
+			onFailure: "Failed to add transformations",
+			run: func() (*BundleUploadResult, error) {
+				return uploadTransformations(concurrency, conflictPolicy, sectionProgress(), fb, formation, stack, bundlePath, message)
+			},
+		},
+		bundleUploadSection{
+			onFailure: "Failed to add helm releases",
+			run: func() (*BundleUploadResult, error) {
+				return uploadHelmReleases(concurrency, conflictPolicy, sectionProgress(), fb, formation, stack, bundlePath, message)
+			},
+		},
+		bundleUploadSection{
+			onFailure: "Failed to add workflows",
+			run: func() (*BundleUploadResult, error) {
+				return uploadWorkflows(ctx, concurrency, conflictPolicy, sectionProgress(), fb, formation, stack, bundlePath, message)
+			},
+		},
+		bundleUploadSection{
+			onFailure: "Failed to add environment variables",
+			run: func() (*BundleUploadResult, error) {
+				return uploadEnvironmentVariables(ctx, concurrency, conflictPolicy, sectionProgress(), fb, formation, stack, bundlePath)
+			},
+		},
+		bundleUploadSection{
+			onFailure: "Failed to add ConfigStore records",
+			run: func() (*BundleUploadResult, error) {
+				return handleBundleUploadConfigStoreRecords(ctx, concurrency, conflictPolicy, sectionProgress(), fb, account, stack, formation, bundlePath)
+			},
+		},
+	)
+
+	sectionSem := newUploadSemaphore(concurrency)
+	results := make([]*BundleUploadResult, len(sections))
+	errs := make([]error, len(sections))
+	sectionSem.run(len(sections), func(i int) {
+		if ctx.Err() != nil {
+			return
 		}
+		results[i], errs[i] = sections[i].run()
+		if errs[i] != nil {
+			cancel()
+		}
+	})
 
+	merged := &BundleUploadResult{}
+	for i, section := range sections {
+		merged.merge(results[i])
+		if errs[i] != nil {
+			fmt.Printf("%s: %s\n", section.onFailure, errs[i].Error())
+		}
 	}
 
-	// add the policies
-	err = uploadPolicies(fb, formation, stack, bundlePath, message)
-	if err != nil {
-		printFatal(err.Error())
-	}
+	return merged
+}
 
-	// add the transformations
-	err = uploadTransformations(fb, formation, stack, bundlePath, message)
-	if err != nil {
-		printFatal(err.Error())
+// findFormationPolicy, findFormationTransformation, findFormationHelmRelease
+// and findFormationWorkflow look up whether a bundled item already exists on
+// formation, so --conflict=overwrite can update it in place instead of
+// letting the batch Add call reject it as a duplicate. Mirrors
+// *cloud66.Formation's own FindStencil, which covers the stencil case.
+func findFormationPolicy(formation *cloud66.Formation, uid string) *cloud66.Policy {
+	for i, policy := range formation.Policies {
+		if policy.Uid == uid {
+			return &formation.Policies[i]
+		}
 	}
+	return nil
+}
 
-	// add helm releases
-	err = uploadHelmReleases(fb, formation, stack, bundlePath, message)
-	if err != nil {
-		printFatal(err.Error())
+func findFormationTransformation(formation *cloud66.Formation, uid string) *cloud66.Transformation {
+	for i, transformation := range formation.Transformations {
+		if transformation.Uid == uid {
+			return &formation.Transformations[i]
+		}
 	}
+	return nil
+}
 
-	// add workflow
-	err = uploadWorkflows(fb, formation, stack, bundlePath, message)
-	if err != nil {
-		printFatal(err.Error())
+func findFormationHelmRelease(formation *cloud66.Formation, displayName string) *cloud66.HelmRelease {
+	for i, release := range formation.HelmReleases {
+		if release.DisplayName == displayName {
+			return &formation.HelmReleases[i]
+		}
 	}
+	return nil
+}
 
-	return formation, nil
+func findFormationWorkflow(formation *cloud66.Formation, name string) *cloud66.Workflow {
+	for i, workflow := range formation.Workflows {
+		if workflow.Name == name {
+			return &formation.Workflows[i]
+		}
+	}
+	return nil
 }
 
-func uploadStencils(baseTemplate *cloud66.BundleBaseTemplates, formation *cloud66.Formation, stack *cloud66.Stack, bundlePath string, message string) error {
+func uploadStencils(concurrency int, conflictPolicy string, progress *bundleUploadProgress, baseTemplate *cloud66.BundleBaseTemplates, formation *cloud66.Formation, stack *cloud66.Stack, bundlePath string, message string) (*BundleUploadResult, error) {
 	// add stencils
-	fmt.Println("Adding stencils...")
-	var err error
-	stencils := make([]*cloud66.Stencil, len(baseTemplate.Stencils))
-	for idx, stencil := range baseTemplate.Stencils {
-		stencils[idx], err = stencil.AsStencil(bundlePath)
-		if err != nil {
-			return err
+	progress.start("stencils", len(baseTemplate.Stencils))
+	result := &BundleUploadResult{}
+
+	parsed := make([]*cloud66.Stencil, len(baseTemplate.Stencils))
+	parseErrs := make([]error, len(baseTemplate.Stencils))
+	newUploadSemaphore(concurrency).run(len(baseTemplate.Stencils), func(i int) {
+		parsed[i], parseErrs[i] = baseTemplate.Stencils[i].AsStencil(bundlePath)
+		progress.increment()
+	})
+
+	stencils := make([]*cloud66.Stencil, 0, len(baseTemplate.Stencils))
+	for i, stencil := range baseTemplate.Stencils {
+		if parseErrs[i] != nil {
+			result.add("stencil", stencil.Filename, bundleUploadFailed, &ValidationErr{Message: parseErrs[i].Error()})
+			continue
 		}
+		stencils = append(stencils, parsed[i])
 	}
 
 	btrIndex := formation.FindIndexByRepoAndBranch(baseTemplate.Repo, baseTemplate.Branch)
 	if btrIndex == -1 {
-		return errors.New("base template repository not found")
-
+		err := &NotFoundErr{Message: fmt.Sprintf("base template repository %s (branch %s) not found on the formation", baseTemplate.Repo, baseTemplate.Branch)}
+		for _, stencil := range stencils {
+			result.add("stencil", stencil.Filename, bundleUploadFailed, err)
+		}
+		progress.finish("Failed to add stencils")
+		return result, err
+	}
+	btrUid := formation.BaseTemplates[btrIndex].Uid
+
+	// an existing stencil (matched by filename) is updated in place under
+	// --conflict=overwrite; everything else still goes through the batch
+	// AddStencils call below.
+	toCreate := make([]*cloud66.Stencil, 0, len(stencils))
+	for _, stencil := range stencils {
+		existing := formation.FindStencil(stencil.Filename)
+		if existing == nil || conflictPolicy != bundleConflictOverwrite {
+			toCreate = append(toCreate, stencil)
+			continue
+		}
+		_, err := client.UpdateStencil(stack.Uid, formation.Uid, existing.Uid, message, []byte(stencil.Body))
+		status := bundleUploadSuccess
+		if err != nil {
+			status = bundleUploadFailed
+		}
+		result.add("stencil", stencil.Filename, status, err)
 	}
 
-	_, err = client.AddStencils(stack.Uid, formation.Uid, formation.BaseTemplates[btrIndex].Uid, stencils, message)
-	if err != nil {
-		return err
+	if len(toCreate) > 0 {
+		_, err := client.AddStencils(stack.Uid, formation.Uid, btrUid, toCreate, message)
+		status := bundleUploadSuccess
+		if err != nil {
+			status = bundleUploadFailed
+		}
+		for _, stencil := range toCreate {
+			result.add("stencil", stencil.Filename, status, err)
+		}
+		if err != nil {
+			progress.finish("Failed to add stencils")
+			return result, err
+		}
 	}
 
-	fmt.Println("Stencils are queued for addition")
+	progress.finish("Stencils are queued for addition")
 
-	return nil
+	return result, nil
 }
 
-func uploadPolicies(bundleFormation *cloud66.FormationBundle, formation *cloud66.Formation, stack *cloud66.Stack, bundlePath string, message string) error {
+func uploadPolicies(concurrency int, conflictPolicy string, progress *bundleUploadProgress, bundleFormation *cloud66.FormationBundle, formation *cloud66.Formation, stack *cloud66.Stack, bundlePath string, message string) (*BundleUploadResult, error) {
 	// add policies
-	fmt.Println("Adding policies...")
-	policies := make([]*cloud66.Policy, 0)
-	for _, policy := range bundleFormation.Policies {
-		polItem, err := policy.AsPolicy(bundlePath)
-		if err != nil {
-			return err
+	progress.start("policies", len(bundleFormation.Policies))
+	result := &BundleUploadResult{}
+
+	parsed := make([]*cloud66.Policy, len(bundleFormation.Policies))
+	parseErrs := make([]error, len(bundleFormation.Policies))
+	newUploadSemaphore(concurrency).run(len(bundleFormation.Policies), func(i int) {
+		parsed[i], parseErrs[i] = bundleFormation.Policies[i].AsPolicy(bundlePath)
+		progress.increment()
+	})
+
+	policies := make([]*cloud66.Policy, 0, len(bundleFormation.Policies))
+	for i, policy := range bundleFormation.Policies {
+		if parseErrs[i] != nil {
+			result.add("policy", policy.Uid, bundleUploadFailed, &ValidationErr{Message: parseErrs[i].Error()})
+			continue
 		}
-		policies = append(policies, polItem)
+		policies = append(policies, parsed[i])
+	}
+
+	toCreate := make([]*cloud66.Policy, 0, len(policies))
+	for _, policy := range policies {
+		existing := findFormationPolicy(formation, policy.Uid)
+		if existing == nil || conflictPolicy != bundleConflictOverwrite {
+			toCreate = append(toCreate, policy)
+			continue
+		}
+		_, err := client.UpdatePolicy(stack.Uid, formation.Uid, existing.Uid, message, []byte(policy.Body))
+		status := bundleUploadSuccess
 		if err != nil {
-			return err
+			status = bundleUploadFailed
 		}
+		result.add("policy", policy.Uid, status, err)
 	}
-	_, err := client.AddPolicies(stack.Uid, formation.Uid, policies, message)
-	if err != nil {
-		return err
+
+	if len(toCreate) > 0 {
+		_, err := client.AddPolicies(stack.Uid, formation.Uid, toCreate, message)
+		status := bundleUploadSuccess
+		if err != nil {
+			status = bundleUploadFailed
+		}
+		for _, policy := range toCreate {
+			result.add("policy", policy.Uid, status, err)
+		}
+		if err != nil {
+			progress.finish("Failed to add policies")
+			return result, err
+		}
 	}
-	fmt.Println("Policies added")
-	return nil
+	progress.finish("Policies added")
+	return result, nil
 }
 
-func uploadTransformations(bundleFormation *cloud66.FormationBundle, formation *cloud66.Formation, stack *cloud66.Stack, bundlePath string, message string) error {
+func uploadTransformations(concurrency int, conflictPolicy string, progress *bundleUploadProgress, bundleFormation *cloud66.FormationBundle, formation *cloud66.Formation, stack *cloud66.Stack, bundlePath string, message string) (*BundleUploadResult, error) {
 	// add transformations
-	fmt.Println("Adding transformations...")
-	transformations := make([]*cloud66.Transformation, 0)
-	for _, transformation := range bundleFormation.Transformations {
-		trItem, err := transformation.AsTransformation(bundlePath)
+	progress.start("transformations", len(bundleFormation.Transformations))
+	result := &BundleUploadResult{}
+
+	parsed := make([]*cloud66.Transformation, len(bundleFormation.Transformations))
+	parseErrs := make([]error, len(bundleFormation.Transformations))
+	newUploadSemaphore(concurrency).run(len(bundleFormation.Transformations), func(i int) {
+		parsed[i], parseErrs[i] = bundleFormation.Transformations[i].AsTransformation(bundlePath)
+		progress.increment()
+	})
+
+	transformations := make([]*cloud66.Transformation, 0, len(bundleFormation.Transformations))
+	for i, transformation := range bundleFormation.Transformations {
+		if parseErrs[i] != nil {
+			result.add("transformation", transformation.Uid, bundleUploadFailed, &ValidationErr{Message: parseErrs[i].Error()})
+			continue
+		}
+		transformations = append(transformations, parsed[i])
+	}
+
+	toCreate := make([]*cloud66.Transformation, 0, len(transformations))
+	for _, transformation := range transformations {
+		existing := findFormationTransformation(formation, transformation.Uid)
+		if existing == nil || conflictPolicy != bundleConflictOverwrite {
+			toCreate = append(toCreate, transformation)
+			continue
+		}
+		_, err := client.UpdateTransformation(stack.Uid, formation.Uid, existing.Uid, message, []byte(transformation.Body))
+		status := bundleUploadSuccess
+		if err != nil {
+			status = bundleUploadFailed
+		}
+		result.add("transformation", transformation.Uid, status, err)
+	}
+
+	if len(toCreate) > 0 {
+		_, err := client.AddTransformations(stack.Uid, formation.Uid, toCreate, message)
+		status := bundleUploadSuccess
 		if err != nil {
-			return err
+			status = bundleUploadFailed
+		}
+		for _, transformation := range toCreate {
+			result.add("transformation", transformation.Uid, status, err)
 		}
-		transformations = append(transformations, trItem)
 		if err != nil {
-			return err
+			progress.finish("Failed to add transformations")
+			return result, err
 		}
 	}
-	_, err := client.AddTransformations(stack.Uid, formation.Uid, transformations, message)
-	if err != nil {
-		return err
+	progress.finish("Transformations added")
+	return result, nil
+}
+
+func uploadHelmReleases(concurrency int, conflictPolicy string, progress *bundleUploadProgress, fb *cloud66.FormationBundle, formation *cloud66.Formation, stack *cloud66.Stack, bundlePath string, message string) (*BundleUploadResult, error) {
+	progress.start("helm releases", len(fb.HelmReleases))
+	result := &BundleUploadResult{}
+
+	parsed := make([]*cloud66.HelmRelease, len(fb.HelmReleases))
+	parseErrs := make([]error, len(fb.HelmReleases))
+	newUploadSemaphore(concurrency).run(len(fb.HelmReleases), func(i int) {
+		parsed[i], parseErrs[i] = fb.HelmReleases[i].AsRelease(bundlePath)
+		progress.increment()
+	})
+
+	helmReleases := make([]*cloud66.HelmRelease, 0, len(fb.HelmReleases))
+	for i, release := range fb.HelmReleases {
+		if parseErrs[i] != nil {
+			result.add("helm_release", release.DisplayName, bundleUploadFailed, &ValidationErr{Message: parseErrs[i].Error()})
+			continue
+		}
+		helmReleases = append(helmReleases, parsed[i])
 	}
-	fmt.Println("Transformations added")
-	return nil
+
+	toCreate := make([]*cloud66.HelmRelease, 0, len(helmReleases))
+	for _, release := range helmReleases {
+		existing := findFormationHelmRelease(formation, release.DisplayName)
+		if existing == nil || conflictPolicy != bundleConflictOverwrite {
+			toCreate = append(toCreate, release)
+			continue
+		}
+		_, err := client.UpdateHelmRelease(stack.Uid, formation.Uid, existing.Uid, message, []byte(release.Body))
+		status := bundleUploadSuccess
+		if err != nil {
+			status = bundleUploadFailed
+		}
+		result.add("helm_release", release.DisplayName, status, err)
+	}
+
+	if len(toCreate) > 0 {
+		_, err := client.AddHelmReleases(stack.Uid, formation.Uid, toCreate, message)
+		status := bundleUploadSuccess
+		if err != nil {
+			status = bundleUploadFailed
+		}
+		for _, release := range toCreate {
+			result.add("helm_release", release.DisplayName, status, err)
+		}
+		if err != nil {
+			progress.finish("Failed to add helm releases")
+			return result, err
+		}
+	}
+	progress.finish("Helm Releases added")
+	return result, nil
 }
 
-func uploadHelmReleases(fb *cloud66.FormationBundle, formation *cloud66.Formation, stack *cloud66.Stack, bundlePath string, message string) error {
-	var err error
-	fmt.Println("Adding helm releases...")
-	helmReleases := make([]*cloud66.HelmRelease, len(fb.HelmReleases))
-	for idx, release := range fb.HelmReleases {
-		helmReleases[idx], err = release.AsRelease(bundlePath)
+func uploadEnvironmentVariables(ctx context.Context, concurrency int, conflictPolicy string, progress *bundleUploadProgress, fb *cloud66.FormationBundle, formation *cloud66.Formation, stack *cloud66.Stack, bundlePath string) (*BundleUploadResult, error) {
+	result := &BundleUploadResult{}
+
+	envVars, err := parseBundleEnvironmentVariables(fb, bundlePath)
+	if err != nil {
+		return result, err
+	}
+
+	remoteEnvVars, err := client.StackEnvVars(stack.Uid)
+	if err != nil {
+		return result, err
+	}
+	existing := make(map[string]bool, len(remoteEnvVars))
+	for _, envVar := range remoteEnvVars {
+		existing[envVar.Key] = true
+	}
+
+	keys := make([]string, 0, len(envVars))
+	for key := range envVars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	progress.start("environment variables", len(keys))
+	statuses := make([]string, len(keys))
+	errs := make([]error, len(keys))
+	newUploadSemaphore(concurrency).run(len(keys), func(i int) {
+		key := keys[i]
+		if ctx.Err() != nil {
+			statuses[i], errs[i] = bundleUploadSkipped, ctx.Err()
+			return
+		}
+
+		var asyncResult *cloud66.AsyncResult
+		var err error
+		if existing[key] && conflictPolicy == bundleConflictOverwrite {
+			asyncResult, err = client.StackEnvVarSet(stack.Uid, key, envVars[key])
+		} else {
+			asyncResult, err = client.StackEnvVarNew(stack.Uid, key, envVars[key])
+		}
 		if err != nil {
-			return err
+			progress.increment()
+			statuses[i], errs[i] = bundleUploadFailed, err
+			return
 		}
+		if asyncResult != nil {
+			if _, err := endEnvVarSet(asyncResult.Id, stack.Uid); err != nil {
+				progress.increment()
+				statuses[i], errs[i] = bundleUploadFailed, err
+				return
+			}
+		}
+		progress.increment()
+		statuses[i], errs[i] = bundleUploadSuccess, nil
+	})
+
+	for i, key := range keys {
+		result.add("env_var", key, statuses[i], errs[i])
 	}
-	_, err = client.AddHelmReleases(stack.Uid, formation.Uid, helmReleases, message)
+	progress.finish("Environment variables added")
+	return result, nil
+}
+
+func handleBundleUploadConfigStoreRecords(ctx context.Context, concurrency int, conflictPolicy string, progress *bundleUploadProgress, fb *cloud66.FormationBundle, account *cloud66.Account, stack *cloud66.Stack, formation *cloud66.Formation, bundlePath string) (*BundleUploadResult, error) {
+	configStoreRecords, err := parseConfigStoreEntriesFromFormationBundle(fb, bundlePath)
 	if err != nil {
-		return err
+		return &BundleUploadResult{}, err
 	}
-	fmt.Println("Helm Releases added")
-	return nil
+
+	return uploadConfigStoreRecords(ctx, concurrency, conflictPolicy, progress, configStoreRecords, account, stack, formation)
 }
 
-func uploadEnvironmentVariables(fb *cloud66.FormationBundle, formation *cloud66.Formation, stack *cloud66.Stack, bundlePath string) error {
+// parseBundleEnvironmentVariables reads every configuration file a bundle
+// carries into a single key/value map, later keys from the same or a
+// subsequent file winning over earlier ones. Shared between
+// uploadEnvironmentVariables and the --dry-run diff path so there's one
+// place that knows the on-disk format.
+func parseBundleEnvironmentVariables(fb *cloud66.FormationBundle, bundlePath string) (map[string]string, error) {
 	envVars := make(map[string]string, 0)
 	for _, envFileName := range fb.Configurations {
 		file, err := os.Open(filepath.Join(bundlePath, "configurations", envFileName))
 		if err != nil {
-			return err
+			return nil, err
 		}
 		defer file.Close()
 
 		scanner := bufio.NewScanner(file)
 		for scanner.Scan() {
-			env := strings.Split(scanner.Text(), "=")
-			if len(env) < 2 {
+			key, value, ok := parseEnvFileLine(scanner.Text())
+			if !ok {
 				fmt.Print("Wrong environment variable value\n")
 				continue
 			}
-			envVars[env[0]] = strings.Join(env[1:], "=")
+			envVars[key] = value
 		}
 
 		if err := scanner.Err(); err != nil {
-			return err
-		}
-	}
-	for key, value := range envVars {
-		asyncResult, err := client.StackEnvVarNew(stack.Uid, key, value)
-		if err != nil {
-			if err.Error() == "Another environment variable with the same key exists. Use PUT to change it." {
-				fmt.Printf("Failed to add the %s environment variable because it already exists\n", key)
-			} else {
-				return err
-			}
-		}
-		if asyncResult != nil {
-			_, err = endEnvVarSet(asyncResult.Id, stack.Uid)
-			if err != nil {
-				return err
-			}
+			return nil, err
 		}
 	}
-	return nil
-}
 
-func handleBundleUploadConfigStoreRecords(fb *cloud66.FormationBundle, account *cloud66.Account, stack *cloud66.Stack, formation *cloud66.Formation, bundlePath string) error {
-	configStoreRecords, err := parseConfigStoreEntriesFromFormationBundle(fb, bundlePath)
-	if err != nil {
-		return err
-	}
+	return envVars, nil
+}
 
-	err = uploadConfigStoreRecords(configStoreRecords, account, stack, formation)
-	if err != nil {
-		return err
+// parseEnvFileLine parses one line of a bundle's configuration file as a
+// KEY=VALUE pair. It tolerates a leading "export " (so a file meant to be
+// sourced by a shell parses the same way) and a single- or double-quoted
+// value, so a value containing "=" or surrounding whitespace round-trips
+// correctly instead of being mangled by a plain strings.Split on "=". A
+// double-quoted value that is a valid Go string literal (as written by
+// quoteEnvValueIfNeeded) is unescaped; any other quoted value is taken
+// literally between its quotes.
+func parseEnvFileLine(line string) (key string, value string, ok bool) {
+	line = strings.TrimSpace(line)
+	line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+	eq := strings.Index(line, "=")
+	if eq < 0 {
+		return "", "", false
+	}
+
+	key = strings.TrimSpace(line[:eq])
+	if key == "" {
+		return "", "", false
+	}
+
+	value = strings.TrimSpace(line[eq+1:])
+	if len(value) >= 2 {
+		quote := value[0]
+		if (quote == '"' || quote == '\'') && value[len(value)-1] == quote {
+			unquoted, err := strconv.Unquote(value)
+			if quote != '"' || err != nil {
+				unquoted = value[1 : len(value)-1]
+			}
+			value = unquoted
+		}
 	}
 
-	return nil
+	return key, value, true
 }
 
 func parseConfigStoreEntriesFromFormationBundle(fb *cloud66.FormationBundle, bundlePath string) (*cloud66.BundledConfigStoreRecords, error) {
@@ -1125,11 +1808,57 @@ func parseConfigStoreEntriesFromFile(filePath string) (*cloud66.BundledConfigSto
 		return nil, err
 	}
 
+	// A record's valueFrom isn't a field cloud66.BundledConfigStoreRecord
+	// knows about, so the same bytes are unmarshalled again into a local
+	// overlay and any references found there are resolved in place.
+	var overlay configStoreValueFromFile
+	if err := yaml.Unmarshal(marshalledResult, &overlay); err != nil {
+		return nil, err
+	}
+	if err := applyConfigStoreValueFrom(&unmarshalledResult, &overlay, filepath.Dir(filePath)); err != nil {
+		return nil, err
+	}
+
 	return &unmarshalledResult, nil
 }
 
-func uploadConfigStoreRecords(configStoreRecords *cloud66.BundledConfigStoreRecords, account *cloud66.Account, stack *cloud66.Stack, formation *cloud66.Formation) error {
-	for _, record := range configStoreRecords.Records {
+// configStoreRecordsPerSecond caps how fast uploadConfigStoreRecords calls
+// CreateConfigStoreRecord, independently of --concurrency, so a wide-open
+// worker pool can't hammer the ConfigStore API past what it'll accept.
+const configStoreRecordsPerSecond = 20
+
+func uploadConfigStoreRecords(ctx context.Context, concurrency int, conflictPolicy string, progress *bundleUploadProgress, configStoreRecords *cloud66.BundledConfigStoreRecords, account *cloud66.Account, stack *cloud66.Stack, formation *cloud66.Formation) (*BundleUploadResult, error) {
+	result := &BundleUploadResult{}
+
+	progress.start("configstore records", len(configStoreRecords.Records))
+	limiter := rate.NewLimiter(rate.Limit(configStoreRecordsPerSecond), 1)
+
+	// Uid of the existing record under each key, scoped by namespace, so
+	// --conflict=overwrite can update in place instead of creating a
+	// duplicate.
+	existingByNamespaceAndKey := make(map[string]map[string]string)
+	for _, namespace := range []string{account.ConfigStoreNamespace, stack.ConfigStoreNamespace} {
+		remoteRecords, err := client.GetConfigStoreRecords(namespace)
+		if err != nil {
+			return result, err
+		}
+		byKey := make(map[string]string, len(remoteRecords))
+		for _, record := range remoteRecords {
+			byKey[record.Key] = record.Uid
+		}
+		existingByNamespaceAndKey[namespace] = byKey
+	}
+
+	records := configStoreRecords.Records
+	statuses := make([]string, len(records))
+	errs := make([]error, len(records))
+	newUploadSemaphore(concurrency).run(len(records), func(i int) {
+		record := records[i]
+		if ctx.Err() != nil {
+			statuses[i], errs[i] = bundleUploadSkipped, ctx.Err()
+			return
+		}
+
 		var namespace string
 		switch record.Scope {
 		case cloud66.BundledConfigStoreAccountScope:
@@ -1137,20 +1866,37 @@ func uploadConfigStoreRecords(configStoreRecords *cloud66.BundledConfigStoreReco
 		case cloud66.BundledConfigStoreStackScope:
 			namespace = stack.ConfigStoreNamespace
 		default:
-			return fmt.Errorf("ConfigStore record scope %s is not supported. Supported values are: %s, %s.", record.Scope, cloud66.BundledConfigStoreAccountScope, cloud66.BundledConfigStoreStackScope)
+			progress.increment()
+			statuses[i], errs[i] = bundleUploadFailed, &ValidationErr{Message: fmt.Sprintf("ConfigStore record scope %s is not supported. Supported values are: %s, %s.", record.Scope, cloud66.BundledConfigStoreAccountScope, cloud66.BundledConfigStoreStackScope)}
+			return
 		}
 
-		_, err := client.CreateConfigStoreRecord(namespace, &record.ConfigStoreRecord)
+		if err := limiter.Wait(ctx); err != nil {
+			progress.increment()
+			statuses[i], errs[i] = bundleUploadSkipped, err
+			return
+		}
+
+		var err error
+		if existingUid, ok := existingByNamespaceAndKey[namespace][record.Key]; ok && conflictPolicy == bundleConflictOverwrite {
+			_, err = client.UpdateConfigStoreRecord(namespace, existingUid, &record.ConfigStoreRecord)
+		} else {
+			_, err = client.CreateConfigStoreRecord(namespace, &record.ConfigStoreRecord)
+		}
+		progress.increment()
 		if err != nil {
-			if strings.Contains(err.Error(), "Duplicate entry") {
-				fmt.Printf("Failed to add the %s ConfigStore record because it already exists\n", record.Key)
-			} else {
-				return err
-			}
+			statuses[i], errs[i] = bundleUploadFailed, err
+			return
 		}
+		statuses[i], errs[i] = bundleUploadSuccess, nil
+	})
+
+	for i, record := range records {
+		result.add("configstore_record", record.Key, statuses[i], errs[i])
 	}
+	progress.finish("ConfigStore records added")
 
-	return nil
+	return result, nil
 }
 
 func downloadBundledConfigStoreRecords(account *cloud66.Account, stack *cloud66.Stack, formation *cloud66.Formation) (*cloud66.BundledConfigStoreRecords, error) {
@@ -1176,8 +1922,19 @@ func downloadBundledConfigStoreRecords(account *cloud66.Account, stack *cloud66.
 	return &result, nil
 }
 
-func saveBundledConfigStoreRecords(bundledConfigStoreRecords *cloud66.BundledConfigStoreRecords, filepath string) error {
-	marshalledOutput, err := yaml.Marshal(&bundledConfigStoreRecords)
+// saveBundledConfigStoreRecords writes bundledConfigStoreRecords to filepath.
+// If valueFromOverlay is non-nil (the bundle was downloaded with
+// --encrypt-with), each record's valueFrom reference is merged into its
+// YAML entry so a later upload knows how to resolve the value back out
+// instead of reading it as plaintext.
+func saveBundledConfigStoreRecords(bundledConfigStoreRecords *cloud66.BundledConfigStoreRecords, valueFromOverlay *configStoreValueFromFile, filepath string) error {
+	var marshalledOutput []byte
+	var err error
+	if valueFromOverlay != nil {
+		marshalledOutput, err = mergeConfigStoreValueFromOverlay(bundledConfigStoreRecords, valueFromOverlay)
+	} else {
+		marshalledOutput, err = yaml.Marshal(&bundledConfigStoreRecords)
+	}
 	if err != nil {
 		return err
 	}
@@ -1190,23 +1947,44 @@ func saveBundledConfigStoreRecords(bundledConfigStoreRecords *cloud66.BundledCon
 	return nil
 }
 
-func uploadWorkflows(fb *cloud66.FormationBundle, formation *cloud66.Formation, stack *cloud66.Stack, bundlePath string, message string) error {
-	fmt.Println("Adding workflow...")
-	for _, workflow := range fb.Workflows {
+func uploadWorkflows(ctx context.Context, concurrency int, conflictPolicy string, progress *bundleUploadProgress, fb *cloud66.FormationBundle, formation *cloud66.Formation, stack *cloud66.Stack, bundlePath string, message string) (*BundleUploadResult, error) {
+	progress.start("workflows", len(fb.Workflows))
+	result := &BundleUploadResult{}
 
-		workflowItem, err := workflow.AsWorkflow(bundlePath)
+	statuses := make([]string, len(fb.Workflows))
+	errs := make([]error, len(fb.Workflows))
+	newUploadSemaphore(concurrency).run(len(fb.Workflows), func(i int) {
+		workflow := fb.Workflows[i]
+		if ctx.Err() != nil {
+			statuses[i], errs[i] = bundleUploadSkipped, ctx.Err()
+			return
+		}
 
+		workflowItem, err := workflow.AsWorkflow(bundlePath)
 		if err != nil {
-			return err
+			progress.increment()
+			statuses[i], errs[i] = bundleUploadFailed, &ValidationErr{Message: err.Error()}
+			return
 		}
 
-		_, err = client.AddWorkflow(stack.Uid, formation.Uid, workflowItem, message)
+		if existing := findFormationWorkflow(formation, workflowItem.Name); existing != nil && conflictPolicy == bundleConflictOverwrite {
+			_, err = client.UpdateWorkflow(stack.Uid, formation.Uid, existing.Uid, message, []byte(workflowItem.Body))
+		} else {
+			_, err = client.AddWorkflow(stack.Uid, formation.Uid, workflowItem, message)
+		}
+		progress.increment()
+		status := bundleUploadSuccess
 		if err != nil {
-			return err
+			status = bundleUploadFailed
 		}
+		statuses[i], errs[i] = status, err
+	})
+
+	for i, workflow := range fb.Workflows {
+		result.add("workflow", workflow.Name, statuses[i], errs[i])
 	}
-	fmt.Println("Workflows added")
-	return nil
+	progress.finish("Workflows added")
+	return result, nil
 }
 
 func getTemplateList(fb *cloud66.FormationBundle) []*cloud66.BaseTemplate {
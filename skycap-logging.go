@@ -0,0 +1,148 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// taskLogger captures both the cx-side log messages and the trackman workflow
+// step output for a single skycap render task, so the full log can be
+// archived and uploaded once the task completes.
+type taskLogger struct {
+	TaskUUID string
+	Dir      string
+	logFile  string
+
+	logger *logrus.Logger
+	file   *os.File
+}
+
+// newTaskLogger opens (creating if needed) a per-task log file under logDir,
+// keyed by taskUUID, and wires up a logrus logger that writes to it in the
+// requested format alongside the process' normal stdout output.
+func newTaskLogger(taskUUID string, logDir string, logFormat string, level logrus.Level) (*taskLogger, error) {
+	if taskUUID == "" {
+		taskUUID = "no-task"
+	}
+
+	if err := os.MkdirAll(logDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create log dir %s: %s", logDir, err.Error())
+	}
+
+	logFile := filepath.Join(logDir, taskUUID+".log")
+	file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file %s: %s", logFile, err.Error())
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(level)
+	logger.SetOutput(io.MultiWriter(os.Stdout, file))
+
+	if logFormat == "json" {
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	}
+
+	return &taskLogger{
+		TaskUUID: taskUUID,
+		Dir:      logDir,
+		logFile:  logFile,
+		logger:   logger,
+		file:     file,
+	}, nil
+}
+
+func (t *taskLogger) Info(args ...interface{}) {
+	t.logger.Info(args...)
+}
+
+func (t *taskLogger) Error(args ...interface{}) {
+	t.logger.Error(args...)
+}
+
+// Writer exposes an io.Writer so it can be handed to the workflow runner to
+// tee step stdout/stderr into the same per-task log file.
+func (t *taskLogger) Writer() io.Writer {
+	return io.MultiWriter(os.Stdout, t.file)
+}
+
+func (t *taskLogger) Close() error {
+	return t.file.Close()
+}
+
+// archiveAndUpload tars and gzips the task's log file and uploads it
+// alongside the task result so operators can retrieve full deploy logs from
+// the Cloud66 side.
+func (t *taskLogger) archiveAndUpload(taskUUID string) error {
+	if taskUUID == "" {
+		return nil
+	}
+
+	archivePath := filepath.Join(t.Dir, taskUUID+".tar.gz")
+	if err := tarGzFiles(archivePath, []string{t.logFile}); err != nil {
+		return fmt.Errorf("failed to archive logs: %s", err.Error())
+	}
+
+	if _, err := client.UploadTaskLogArchive(QUEUE_NAME, taskUUID, archivePath); err != nil {
+		return fmt.Errorf("failed to upload log archive: %s", err.Error())
+	}
+
+	return nil
+}
+
+// tarGzFiles writes the given files into a single .tar.gz archive at dest.
+func tarGzFiles(dest string, files []string) error {
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gzWriter := gzip.NewWriter(out)
+	defer gzWriter.Close()
+
+	tarWriter := tar.NewWriter(gzWriter)
+	defer tarWriter.Close()
+
+	for _, f := range files {
+		if err := addFileToTar(tarWriter, f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addFileToTar(tarWriter *tar.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.Base(path)
+
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tarWriter, file)
+	return err
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	skycapQueuePopsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "skycap_queue_pops_total",
+		Help: "Total number of times the skycap render queue was polled",
+	})
+
+	skycapRenderTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "skycap_render_total",
+		Help: "Total number of skycap renders, labeled by result",
+	}, []string{"result"})
+
+	skycapRenderDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "skycap_render_duration_seconds",
+		Help: "Time taken to run a skycap render's workflow",
+	})
+
+	skycapQueueBackoffSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "skycap_queue_backoff_seconds",
+		Help: "Current backoff interval before the next queue poll",
+	})
+
+	skycapInflightGauge = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "skycap_inflight",
+		Help: "Number of skycap renders currently in flight",
+	}, func() float64 {
+		return float64(skycapInflight.Load())
+	})
+)
+
+// startSkycapMetricsServer starts an HTTP server exposing /metrics and
+// /healthz on addr, for operators running the listener as a long-lived
+// service. It runs until the process exits.
+func startSkycapMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			printError(fmt.Sprintf("metrics server stopped: %s", err.Error()))
+		}
+	}()
+}
+
+// observeRenderDuration records how long a workflow.Run call took.
+func observeRenderDuration(start time.Time) {
+	skycapRenderDuration.Observe(time.Since(start).Seconds())
+}
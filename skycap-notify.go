@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cloud66-oss/trackman/notifiers"
+	trackmanType "github.com/cloud66-oss/trackman/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// skycapDeployContext carries the deploy's identifying information so the
+// notifier backends can describe which formation/snapshot/stack an event is
+// about, which the bare trackman Event doesn't know about.
+type skycapDeployContext struct {
+	TaskUUID      string
+	FormationName string
+	FormationUID  string
+	SnapshotUID   string
+	StackUID      string
+}
+
+type skycapDeployContextKey struct{}
+
+var skycapDeployContextValue = skycapDeployContextKey{}
+
+func withSkycapDeployContext(ctx context.Context, dc skycapDeployContext) context.Context {
+	return context.WithValue(ctx, skycapDeployContextValue, dc)
+}
+
+func skycapDeployContextFrom(ctx context.Context) skycapDeployContext {
+	dc, _ := ctx.Value(skycapDeployContextValue).(skycapDeployContext)
+	return dc
+}
+
+// skycapNotifierFunc matches the signature of trackmanType.WorkflowOptions.Notifier,
+// so values of this type can be assigned to that field directly.
+type skycapNotifierFunc func(ctx context.Context, logger *logrus.Logger, event *trackmanType.Event) error
+
+// fanOutNotifier forwards every event to all the given notifiers, continuing
+// on individual failures and returning the first error encountered, if any.
+func fanOutNotifier(notifs ...skycapNotifierFunc) skycapNotifierFunc {
+	return func(ctx context.Context, logger *logrus.Logger, event *trackmanType.Event) error {
+		var firstErr error
+		for _, n := range notifs {
+			if err := n(ctx, logger, event); err != nil {
+				logger.Errorf("notifier failed: %s", err.Error())
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		return firstErr
+	}
+}
+
+// slackNotifier posts a human readable start/success/failure message to a
+// Slack incoming webhook.
+func slackNotifier(webhookURL string) skycapNotifierFunc {
+	return func(ctx context.Context, logger *logrus.Logger, event *trackmanType.Event) error {
+		text := skycapNotifierText(ctx, event)
+		if text == "" {
+			return nil
+		}
+
+		body, err := json.Marshal(map[string]string{"text": text})
+		if err != nil {
+			return err
+		}
+
+		return postJSON(webhookURL, body)
+	}
+}
+
+// webhookNotifier POSTs a JSON envelope with the deploy identifiers and the
+// step's status to an arbitrary webhook URL.
+func webhookNotifier(webhookURL string) skycapNotifierFunc {
+	return func(ctx context.Context, logger *logrus.Logger, event *trackmanType.Event) error {
+		dc := skycapDeployContextFrom(ctx)
+		envelope := map[string]interface{}{
+			"task_uuid":      dc.TaskUUID,
+			"formation_uid":  dc.FormationUID,
+			"formation_name": dc.FormationName,
+			"snapshot_uid":   dc.SnapshotUID,
+			"stack_uid":      dc.StackUID,
+			"step":           event.Payload.Spinner.Name,
+			"status":         event.Name,
+		}
+		body, err := json.Marshal(envelope)
+		if err != nil {
+			return err
+		}
+
+		return postJSON(webhookURL, body)
+	}
+}
+
+// fileNotifier appends a newline-delimited JSON record for every event to
+// the given file, for consumption by external log shippers.
+func fileNotifier(path string) skycapNotifierFunc {
+	return func(ctx context.Context, logger *logrus.Logger, event *trackmanType.Event) error {
+		dc := skycapDeployContextFrom(ctx)
+		record := map[string]interface{}{
+			"time":           time.Now().UTC().Format(time.RFC3339),
+			"task_uuid":      dc.TaskUUID,
+			"formation_uid":  dc.FormationUID,
+			"formation_name": dc.FormationName,
+			"snapshot_uid":   dc.SnapshotUID,
+			"stack_uid":      dc.StackUID,
+			"step":           event.Payload.Spinner.Name,
+			"status":         event.Name,
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = f.Write(append(line, '\n'))
+		return err
+	}
+}
+
+// taskLogNotifier writes every notifier-visible event to tlog's writer, so
+// the archived per-task log carries the same start/success/failure narrative
+// that the console/slack/webhook notifiers show, not just cx's own Info/Error
+// calls around the workflow.Run() boundary.
+func taskLogNotifier(tlog *taskLogger) skycapNotifierFunc {
+	return func(ctx context.Context, logger *logrus.Logger, event *trackmanType.Event) error {
+		text := skycapNotifierText(ctx, event)
+		if text == "" {
+			return nil
+		}
+
+		_, err := fmt.Fprintln(tlog.Writer(), text)
+		return err
+	}
+}
+
+func skycapNotifierText(ctx context.Context, event *trackmanType.Event) string {
+	dc := skycapDeployContextFrom(ctx)
+	switch event.Name {
+	case trackmanType.EventRunRequested:
+		return fmt.Sprintf("Deploy started for formation %s, snapshot %s", dc.FormationName, dc.SnapshotUID)
+	case trackmanType.EventRunSuccess:
+		return fmt.Sprintf("Deploy succeeded for formation %s, snapshot %s", dc.FormationName, dc.SnapshotUID)
+	case trackmanType.EventRunError, trackmanType.EventRunFail, trackmanType.EventRunTimeout, trackmanType.EventRunWaitError:
+		return fmt.Sprintf("Deploy failed for formation %s, snapshot %s: step %s (%v)", dc.FormationName, dc.SnapshotUID, event.Payload.Spinner.Name, event.Payload.Extras)
+	default:
+		return ""
+	}
+}
+
+func postJSON(url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notifier received status %d from %s", resp.StatusCode, url)
+	}
+
+	return nil
+}
+
+// skycapNotifierFromFlags builds the fan-out notifier requested via the
+// --notifier flag (a comma separated list of console, slack, webhook, file),
+// validating that each selected backend has the flags it needs.
+func skycapNotifierFromFlags(names string, slackWebhookURL string, webhookURL string, notifyFile string) (skycapNotifierFunc, error) {
+	if names == "" {
+		names = "console"
+	}
+
+	var built []skycapNotifierFunc
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "console":
+			built = append(built, skycapNotifierFunc(notifiers.ConsoleNotify))
+		case "slack":
+			if slackWebhookURL == "" {
+				return nil, fmt.Errorf("--slack-webhook-url is required when using the slack notifier")
+			}
+			built = append(built, slackNotifier(slackWebhookURL))
+		case "webhook":
+			if webhookURL == "" {
+				return nil, fmt.Errorf("--webhook-url is required when using the webhook notifier")
+			}
+			built = append(built, webhookNotifier(webhookURL))
+		case "file":
+			if notifyFile == "" {
+				return nil, fmt.Errorf("--notify-file is required when using the file notifier")
+			}
+			built = append(built, fileNotifier(notifyFile))
+		default:
+			return nil, fmt.Errorf("unknown notifier %q. Supported values are console, slack, webhook, file", name)
+		}
+	}
+
+	return fanOutNotifier(built...), nil
+}
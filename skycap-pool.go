@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/sirupsen/logrus"
+)
+
+// drainTimeout bounds how long graceful shutdown waits for in-flight
+// updateTask calls to finish before the process exits anyway.
+const drainTimeout = 30 * time.Second
+
+// stackLocks hands out a per-stack semaphore so that two tasks against the
+// same stack still serialize (avoiding conflicting deploys) while unrelated
+// stacks are rendered in parallel.
+type stackLocks struct {
+	mu         sync.Mutex
+	perStack   int
+	semaphores map[string]chan struct{}
+}
+
+func newStackLocks(perStack int) *stackLocks {
+	if perStack < 1 {
+		perStack = 1
+	}
+	return &stackLocks{
+		perStack:   perStack,
+		semaphores: make(map[string]chan struct{}),
+	}
+}
+
+func (s *stackLocks) acquire(stackUID string) chan struct{} {
+	s.mu.Lock()
+	sem, ok := s.semaphores[stackUID]
+	if !ok {
+		sem = make(chan struct{}, s.perStack)
+		s.semaphores[stackUID] = sem
+	}
+	s.mu.Unlock()
+
+	sem <- struct{}{}
+	return sem
+}
+
+func (s *stackLocks) release(sem chan struct{}) {
+	<-sem
+}
+
+// skycapRenderJob is a single payload dispatched from a poller to a worker.
+type skycapRenderJob struct {
+	payload skycapRenderQueuePayload
+}
+
+// skycapWorkerPool polls the render queue from maxConcurrent goroutines and
+// dispatches the popped payloads to workers that run doRender, serializing
+// same-stack tasks via stackLocks.
+type skycapWorkerPool struct {
+	maxConcurrent int
+	locks         *stackLocks
+	jobs          chan skycapRenderJob
+	wg            sync.WaitGroup
+	pollersWg     sync.WaitGroup
+	shutdown      chan struct{}
+
+	level       logrus.Level
+	logFormat   string
+	logDir      string
+	notifier    skycapNotifierFunc
+	retryPolicy taskRetryPolicy
+}
+
+func newSkycapWorkerPool(maxConcurrent int, perStackConcurrency int, level logrus.Level, logFormat string, logDir string, notifier skycapNotifierFunc, retryPolicy taskRetryPolicy) *skycapWorkerPool {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+
+	return &skycapWorkerPool{
+		maxConcurrent: maxConcurrent,
+		locks:         newStackLocks(perStackConcurrency),
+		jobs:          make(chan skycapRenderJob, maxConcurrent*2),
+		shutdown:      make(chan struct{}),
+		level:         level,
+		logFormat:     logFormat,
+		logDir:        logDir,
+		notifier:      notifier,
+		retryPolicy:   retryPolicy,
+	}
+}
+
+// run spawns maxConcurrent pollers (each calling client.PopQueue on its own
+// backoff ticker) and maxConcurrent workers draining the resulting jobs.
+func (p *skycapWorkerPool) run(interval time.Duration) {
+	for i := 0; i < p.maxConcurrent; i++ {
+		p.pollersWg.Add(1)
+		go p.poll(interval)
+	}
+	for i := 0; i < p.maxConcurrent; i++ {
+		go p.work()
+	}
+}
+
+// poll drives the queue with two independent backoff policies: idleBackoff
+// paces successful-but-empty polls at a steady interval, while errBackoff
+// grows exponentially while PopQueue itself is failing (e.g. server errors),
+// so a run of transport errors no longer resets or is reset by idle polling.
+func (p *skycapWorkerPool) poll(interval time.Duration) {
+	defer p.pollersWg.Done()
+
+	idleBackoff := backoff.NewExponentialBackOff()
+	idleBackoff.InitialInterval = interval
+	idleBackoff.MaxInterval = interval
+	idleBackoff.MaxElapsedTime = 0
+
+	errBackoff := backoff.NewExponentialBackOff()
+	errBackoff.InitialInterval = interval
+	errBackoff.MaxElapsedTime = MAX_BACKOFF * time.Second
+
+	// We drive the ticks ourselves (rather than backoff.NewTicker) so we can
+	// observe the interval NextBackOff() hands out without calling it twice.
+	wait := idleBackoff.NextBackOff()
+	skycapQueueBackoffSeconds.Set(wait.Seconds())
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	rearmIdle := func() {
+		wait := idleBackoff.NextBackOff()
+		skycapQueueBackoffSeconds.Set(wait.Seconds())
+		timer.Reset(wait)
+	}
+	rearmErr := func() {
+		wait := errBackoff.NextBackOff()
+		skycapQueueBackoffSeconds.Set(wait.Seconds())
+		timer.Reset(wait)
+	}
+
+	for {
+		select {
+		case <-p.shutdown:
+			return
+		case <-timer.C:
+			skycapQueuePopsTotal.Inc()
+
+			msg, err := client.PopQueue(QUEUE_NAME)
+			if err != nil {
+				printError(err.Error())
+				rearmErr()
+				continue
+			}
+			errBackoff.Reset()
+			if msg == nil {
+				rearmIdle()
+				continue
+			}
+
+			var payload skycapRenderQueuePayload
+			if err := json.Unmarshal(msg, &payload); err != nil {
+				printError("Error in fetching items from the queue %v\n", err)
+				rearmIdle()
+				continue
+			}
+			if payload.Formation == nil || payload.Snapshot == nil || payload.Stack == nil {
+				rearmIdle()
+				continue
+			}
+
+			// Add happens here, on the producer side, before the job is ever
+			// visible on p.jobs - stop() only closes p.jobs once pollersWg
+			// confirms every poller (and therefore every Add below) has
+			// already happened, so wg.Wait() there can't race a late Add
+			p.wg.Add(1)
+			select {
+			case p.jobs <- skycapRenderJob{payload: payload}:
+			case <-p.shutdown:
+				p.wg.Done()
+				return
+			}
+			rearmIdle()
+		}
+	}
+}
+
+func (p *skycapWorkerPool) work() {
+	for job := range p.jobs {
+		p.runJob(job)
+	}
+}
+
+func (p *skycapWorkerPool) runJob(job skycapRenderJob) {
+	defer p.wg.Done()
+
+	stackUID := ""
+	if job.payload.Stack != nil {
+		stackUID = job.payload.Stack.Uid
+	}
+
+	sem := p.locks.acquire(stackUID)
+	defer p.locks.release(sem)
+
+	doRenderPayload(job.payload, p.level, p.logFormat, p.logDir, p.notifier, p.retryPolicy)
+}
+
+// stop signals all pollers to stop picking up new work and waits up to
+// drainTimeout for in-flight tasks (and their updateTask calls) to finish.
+func (p *skycapWorkerPool) stop() {
+	close(p.shutdown)
+
+	// only close jobs once every poller has confirmed it's no longer sending
+	// to it, otherwise a poller blocked in its own "case p.jobs <- ...:" select
+	// could race the close and panic
+	p.pollersWg.Wait()
+	close(p.jobs)
+
+	drained := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(drainTimeout):
+		printError("Timed out waiting for in-flight tasks to drain\n")
+	}
+}
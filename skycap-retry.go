@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+// DEAD_LETTER_QUEUE_NAME holds tasks that have exhausted their retries, for
+// manual inspection or replay.
+const DEAD_LETTER_QUEUE_NAME = "skycap_render_dead_letter_queue"
+
+// taskRetryPolicy controls how many times a task is re-enqueued after a
+// run/step failure, and how long to wait between attempts, before it is
+// moved to the dead letter queue.
+type taskRetryPolicy struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// delay returns how long to wait before re-enqueuing a payload that has just
+// failed its attempt'th try.
+func (p taskRetryPolicy) delay(attempt int) time.Duration {
+	exp := backoff.NewExponentialBackOff()
+	exp.InitialInterval = p.InitialBackoff
+	exp.MaxInterval = p.MaxBackoff
+	exp.MaxElapsedTime = 0
+
+	wait := exp.InitialInterval
+	for i := 1; i < attempt; i++ {
+		wait = exp.NextBackOff()
+	}
+	return wait
+}
+
+// handleRenderFailure re-enqueues payload with its attempt counter
+// incremented, waiting according to retryPolicy, until policy.MaxRetries is
+// reached, after which the payload is moved to the dead letter queue along
+// with the error trace that caused the final failure. It is meant to be run
+// in its own goroutine so a retry delay never holds up a worker.
+func handleRenderFailure(payload skycapRenderQueuePayload, policy taskRetryPolicy, errTrace string) {
+	payload.Attempt++
+	payload.LastError = errTrace
+
+	queueName := QUEUE_NAME
+	if payload.Attempt > policy.MaxRetries {
+		queueName = DEAD_LETTER_QUEUE_NAME
+	} else {
+		time.Sleep(policy.delay(payload.Attempt))
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		printError("Failed to marshal task %s for %s: %s\n", payload.TaskUUID, queueName, err.Error())
+		return
+	}
+
+	if _, err := client.PushQueue(queueName, body); err != nil {
+		printError("Failed to push task %s to %s: %s\n", payload.TaskUUID, queueName, err.Error())
+	}
+}
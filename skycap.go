@@ -3,17 +3,15 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/cenkalti/backoff"
 	"github.com/cloud66-oss/cloud66"
-	"github.com/cloud66-oss/trackman/notifiers"
 	trackmanType "github.com/cloud66-oss/trackman/utils"
 	"github.com/cloud66/cli"
 	"github.com/sirupsen/logrus"
@@ -25,6 +23,7 @@ const (
 	TASK_SUCCESS = "success"
 	TASK_FAIL    = "fail"
 	TASK_ACK     = "ack"
+	TASK_RETRY   = "retry"
 )
 
 var cmdSkycap = &Command{
@@ -41,9 +40,18 @@ type skycapRenderQueuePayload struct {
 	Snapshot  *cloud66.Snapshot  `json:"snapshot"`
 	Stack     *cloud66.Stack     `json:"stack"`
 	Workflow  *cloud66.Workflow  `json:"workflow"`
+
+	// Attempt counts how many times this payload has already been retried
+	// after a run/step failure, and LastError holds the most recent failure
+	// so it can be reported if the task ends up on the dead letter queue.
+	Attempt   int    `json:"attempt"`
+	LastError string `json:"last_error,omitempty"`
 }
 
-var skycapListenDeployRunning bool
+// skycapInflight tracks the number of renders currently being processed by
+// the worker pool. It replaces the old single-task "running" boolean now
+// that multiple renders can run concurrently.
+var skycapInflight atomic.Int64
 
 func buildSkycap() cli.Command {
 	base := buildBasicCommand()
@@ -67,6 +75,62 @@ func buildSkycap() cli.Command {
 							Value: 10 * time.Second,
 							Usage: "[OPTIONAL] Queue check interval. Must be bigger than 5 seconds",
 						},
+						cli.StringFlag{
+							Name:  "log-format",
+							Value: "text",
+							Usage: "[OPTIONAL] log output format for per-task log files. Use 'text' or 'json'",
+						},
+						cli.StringFlag{
+							Name:  "log-dir",
+							Value: "",
+							Usage: "[OPTIONAL] directory to store per-task log files in. Defaults to a 'skycap-logs' folder under the current directory",
+						},
+						cli.IntFlag{
+							Name:  "max-concurrent",
+							Value: 1,
+							Usage: "[OPTIONAL] number of renders to process in parallel",
+						},
+						cli.IntFlag{
+							Name:  "per-stack-concurrency",
+							Value: 1,
+							Usage: "[OPTIONAL] number of renders to allow in parallel for the same stack. Keep at 1 to avoid conflicting deploys",
+						},
+						cli.StringFlag{
+							Name:  "notifier",
+							Value: "console",
+							Usage: "[OPTIONAL] comma separated list of notifier backends to use: console, slack, webhook, file",
+						},
+						cli.StringFlag{
+							Name:  "slack-webhook-url",
+							Usage: "[OPTIONAL] Slack incoming webhook URL. Required when 'slack' is in --notifier",
+						},
+						cli.StringFlag{
+							Name:  "webhook-url",
+							Usage: "[OPTIONAL] Webhook URL to POST deploy events to. Required when 'webhook' is in --notifier",
+						},
+						cli.StringFlag{
+							Name:  "notify-file",
+							Usage: "[OPTIONAL] File to append newline-delimited JSON deploy events to. Required when 'file' is in --notifier",
+						},
+						cli.StringFlag{
+							Name:  "metrics-addr",
+							Usage: "[OPTIONAL] address (e.g. :9090) to serve Prometheus /metrics and /healthz on. Disabled if not set",
+						},
+						cli.IntFlag{
+							Name:  "max-task-retries",
+							Value: 3,
+							Usage: "[OPTIONAL] number of times to re-enqueue a task after a run/step failure before moving it to the dead letter queue",
+						},
+						cli.DurationFlag{
+							Name:  "task-retry-initial",
+							Value: 5 * time.Second,
+							Usage: "[OPTIONAL] delay before the first task retry",
+						},
+						cli.DurationFlag{
+							Name:  "task-retry-max",
+							Value: 2 * time.Minute,
+							Usage: "[OPTIONAL] upper bound on the delay between task retries",
+						},
 					},
 				},
 			},
@@ -77,7 +141,6 @@ func buildSkycap() cli.Command {
 }
 
 func runSkycapListenDeploy(c *cli.Context) {
-	skycapListenDeployRunning = false
 	level := logrus.InfoLevel
 	logLevel := c.String("log-level")
 
@@ -95,61 +158,88 @@ func runSkycapListenDeploy(c *cli.Context) {
 		printFatal("Interval must be 5 seconds or longer")
 	}
 
-	printInfo("Listening for Skycap snapshot events...")
-	close := make(chan os.Signal, 1)
-	signal.Notify(close, os.Interrupt, syscall.SIGTERM)
+	logFormat := c.String("log-format")
+	if logFormat != "text" && logFormat != "json" {
+		printFatal("log-format must be 'text' or 'json'")
+	}
 
-	operation := func() error {
-		msg, err := client.PopQueue(QUEUE_NAME)
-		if err != nil {
-			return err
-		}
-		if msg != nil {
-			doRender(msg, level)
-		}
+	logDir := c.String("log-dir")
+	if logDir == "" {
+		logDir = "skycap-logs"
+	}
 
-		return nil
+	maxConcurrent := c.Int("max-concurrent")
+	if maxConcurrent < 1 {
+		printFatal("max-concurrent must be 1 or greater")
 	}
 
-	exp := backoff.NewExponentialBackOff()
-	exp.InitialInterval = interval
-	exp.MaxElapsedTime = MAX_BACKOFF * time.Second
+	perStackConcurrency := c.Int("per-stack-concurrency")
+	if perStackConcurrency < 1 {
+		printFatal("per-stack-concurrency must be 1 or greater")
+	}
 
-	ticker := backoff.NewTicker(exp)
+	notifier, err := skycapNotifierFromFlags(c.String("notifier"), c.String("slack-webhook-url"), c.String("webhook-url"), c.String("notify-file"))
+	if err != nil {
+		printFatal(err.Error())
+	}
 
-	for {
-		select {
-		case <-ticker.C:
-			if skycapListenDeployRunning {
-				continue
-			}
-			if err := operation(); err != nil {
-				printError(err.Error())
-			} else {
-				exp.Reset()
-			}
-		case <-close:
-			printInfo("Exiting...")
-			os.Exit(0)
-		}
+	maxTaskRetries := c.Int("max-task-retries")
+	if maxTaskRetries < 0 {
+		printFatal("max-task-retries must be 0 or greater")
+	}
+
+	taskRetryInitial := c.Duration("task-retry-initial")
+	if taskRetryInitial <= 0 {
+		printFatal("task-retry-initial must be greater than 0")
+	}
+
+	taskRetryMax := c.Duration("task-retry-max")
+	if taskRetryMax < taskRetryInitial {
+		printFatal("task-retry-max must be greater than or equal to task-retry-initial")
+	}
+
+	retryPolicy := taskRetryPolicy{
+		MaxRetries:     maxTaskRetries,
+		InitialBackoff: taskRetryInitial,
+		MaxBackoff:     taskRetryMax,
 	}
+
+	if metricsAddr := c.String("metrics-addr"); metricsAddr != "" {
+		startSkycapMetricsServer(metricsAddr)
+		printInfo(fmt.Sprintf("Serving metrics and health checks on %s", metricsAddr))
+	}
+
+	printInfo(fmt.Sprintf("Listening for Skycap snapshot events with %d worker(s)...", maxConcurrent))
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	pool := newSkycapWorkerPool(maxConcurrent, perStackConcurrency, level, logFormat, logDir, notifier, retryPolicy)
+	pool.run(interval)
+
+	<-sig
+	printInfo("Shutting down, waiting for in-flight tasks to finish...")
+	pool.stop()
+	printInfo("Exiting...")
+	os.Exit(0)
 }
 
-func doRender(msg json.RawMessage, level logrus.Level) {
-	skycapListenDeployRunning = true
-	defer func() {
-		skycapListenDeployRunning = false
-	}()
+func doRenderPayload(payload skycapRenderQueuePayload, level logrus.Level, logFormat string, logDir string, notifier skycapNotifierFunc, retryPolicy taskRetryPolicy) {
+	skycapInflight.Add(1)
+	defer skycapInflight.Add(-1)
 
-	var payload skycapRenderQueuePayload
-	err := json.Unmarshal(msg, &payload)
+	tlog, err := newTaskLogger(payload.TaskUUID, logDir, logFormat, level)
 	if err != nil {
-		printError("Error in fetching items from the queue %v\n", err)
-		return
+		printError("Failed to open task log: %s\n", err.Error())
+		tlog = nil
 	}
-
-	if payload.Formation == nil || payload.Snapshot == nil || payload.Stack == nil {
-		return
+	if tlog != nil {
+		defer func() {
+			if archiveErr := tlog.archiveAndUpload(payload.TaskUUID); archiveErr != nil {
+				printError("Failed to archive/upload task log: %s\n", archiveErr.Error())
+			}
+			tlog.Close()
+		}()
+		notifier = fanOutNotifier(notifier, taskLogNotifier(tlog))
 	}
 
 	var workflowName string
@@ -168,38 +258,59 @@ func doRender(msg json.RawMessage, level logrus.Level) {
 		updateTask(payload.TaskUUID, TASK_ACK, "")
 	}
 
-	if payload.Workflow == nil {
-		printInfo(fmt.Sprintf("Running task %s formation %s, using snapshot %s (taken on %s) for stack %s\n", taskMsg, payload.Formation.Name, payload.Snapshot.Uid, payload.Snapshot.UpdatedAt, payload.Stack.Name))
-	} else {
-		printInfo(fmt.Sprintf("Running task %s formation %s, workflow %s using snapshot %s (taken on %s) for stack %s\n", taskMsg, payload.Formation.Name, payload.Workflow.Name, payload.Snapshot.Uid, payload.Snapshot.UpdatedAt, payload.Stack.Name))
+	startMsg := fmt.Sprintf("Running task %s formation %s, using snapshot %s (taken on %s) for stack %s\n", taskMsg, payload.Formation.Name, payload.Snapshot.Uid, payload.Snapshot.UpdatedAt, payload.Stack.Name)
+	if payload.Workflow != nil {
+		startMsg = fmt.Sprintf("Running task %s formation %s, workflow %s using snapshot %s (taken on %s) for stack %s\n", taskMsg, payload.Formation.Name, payload.Workflow.Name, payload.Snapshot.Uid, payload.Snapshot.UpdatedAt, payload.Stack.Name)
+	}
+	printInfo(startMsg)
+	if tlog != nil {
+		tlog.Info(startMsg)
 	}
 
 	workflowWrapper, err := client.GetWorkflow(payload.Stack.Uid, payload.Formation.Uid, payload.Snapshot.Uid, true, workflowName)
 	if err != nil {
 		printError("Error in fetching default workflow %s\n", err)
+		if tlog != nil {
+			tlog.Error(err.Error())
+		}
 		updateTask(payload.TaskUUID, TASK_FAIL, err.Error())
 		return
 	}
 
 	ctx := context.Background()
 	ctx = context.WithValue(ctx, trackmanType.CtxLogLevel, level)
+	ctx = withSkycapDeployContext(ctx, skycapDeployContext{
+		TaskUUID:      payload.TaskUUID,
+		FormationName: payload.Formation.Name,
+		FormationUID:  payload.Formation.Uid,
+		SnapshotUID:   payload.Snapshot.Uid,
+		StackUID:      payload.Stack.Uid,
+	})
 
 	reader := bytes.NewReader(workflowWrapper.Workflow)
 	options := &trackmanType.WorkflowOptions{
-		Notifier:    notifiers.ConsoleNotify,
+		Notifier:    notifier,
 		Concurrency: runtime.NumCPU() - 1,
 		Timeout:     10 * time.Minute,
 	}
 
+	ctx, cancel := context.WithTimeout(ctx, options.Timeout)
+	defer cancel()
+
 	var runErr string
 	workflow, err := trackmanType.LoadWorkflowFromReader(ctx, options, reader)
 	if err != nil {
 		runErr = err.Error()
 		fmt.Println(runErr)
+		if tlog != nil {
+			tlog.Error(runErr)
+		}
 		updateTask(payload.TaskUUID, TASK_FAIL, runErr)
 		return
 	}
+	renderStart := time.Now()
 	runErrors, stepErrors := workflow.Run(ctx)
+	observeRenderDuration(renderStart)
 	var stepErr string
 	if runErrors != nil {
 		runErr = runErrors.Error()
@@ -211,22 +322,35 @@ func doRender(msg json.RawMessage, level logrus.Level) {
 	}
 
 	if runErrors != nil || stepErrors != nil {
-		updateTask(payload.TaskUUID, TASK_FAIL, fmt.Sprintf("Run Errors %s\nStep Errors: %s\n", runErr, stepErr))
-	}
-
-	if stepErrors != nil {
-
+		combined := fmt.Sprintf("Run Errors %s\nStep Errors: %s\n", runErr, stepErr)
+		if tlog != nil {
+			tlog.Error(combined)
+		}
+		// mirror handleRenderFailure's own check on the same (post-increment)
+		// basis: it compares payload.Attempt+1 against MaxRetries, since it
+		// increments Attempt before deciding dead-letter vs. requeue
+		if payload.Attempt+1 > retryPolicy.MaxRetries {
+			updateTask(payload.TaskUUID, TASK_FAIL, combined)
+		} else {
+			updateTask(payload.TaskUUID, TASK_RETRY, combined)
+		}
+		go handleRenderFailure(payload, retryPolicy, combined)
 	}
 
 	if stepErrors != nil || runErrors != nil {
 		printError("Deployment failed or has errors")
 	} else {
 		printInfo("Finished deployment")
+		if tlog != nil {
+			tlog.Info("Finished deployment")
+		}
 		updateTask(payload.TaskUUID, TASK_SUCCESS, "")
 	}
 }
 
 func updateTask(taskUUID string, state string, runResult string) {
+	skycapRenderTotal.WithLabelValues(state).Inc()
+
 	if taskUUID == "" {
 		printInfo("No task to update")
 		return
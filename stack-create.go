@@ -15,64 +15,38 @@ import (
 )
 
 func runCreateStack(c *cli.Context) {
-	name := c.String("name")
-	environment := c.String("environment")
-	serviceYamlFile := c.String("service_yaml")
-	manifestYamlFile := c.String("manifest_yaml")
-	manifestYaml := ""
-
-	if len(name) < 5 {
-		printFatal("name is required and must be at least 5 characters long")
-	}
-	if environment == "" {
-		printFatal("environment is required")
-	}
+	accountInfo, err := currentAccountInfo()
+	must(err)
+	fmt.Printf("Using account: %s\n", accountInfo.Owner)
 
-	// handle service yaml file
-	if serviceYamlFile == "" {
-		printFatal("service_yaml file path is required")
+	var spec *cxStackSpec
+	if specFile := c.String("spec"); specFile != "" {
+		spec, err = loadStackSpec(expandPath(specFile))
+		must(err)
 	} else {
-		serviceYamlFile = expandPath(serviceYamlFile)
+		spec, err = buildStackSpecInteractively(c, *accountInfo)
+		must(err)
 	}
-	serviceYamlBytes, err := ioutil.ReadFile(serviceYamlFile)
-	must(err)
-	serviceYaml := string(serviceYamlBytes)
 
-	accountInfo, err := currentAccountInfo()
+	serviceYamlBytes, err := ioutil.ReadFile(expandPath(spec.ServiceYaml))
 	must(err)
+	serviceYaml := string(serviceYamlBytes)
 
-	fmt.Printf("Using account: %s\n", accountInfo.Owner)
-
-	targetOptions := make(map[string]string)
-	if manifestYamlFile != "" {
-
+	manifestYaml := ""
+	if spec.ManifestYaml != "" {
 		fmt.Println("Using supplied manifest file")
-		manifestYamlFile = expandPath(manifestYamlFile)
-		manifestYamlBytes, err := ioutil.ReadFile(manifestYamlFile)
+		manifestYamlBytes, err := ioutil.ReadFile(expandPath(spec.ManifestYaml))
 		must(err)
 		manifestYaml = string(manifestYamlBytes)
 	} else {
-
 		fmt.Println("Note: No manifest provided; for additional options you can provide your own manifest with this command")
-		targetCloud, err := askForCloud(*accountInfo)
-		must(err)
-		targetOptions["cloud"] = targetCloud
-
-		targetRegion, targetSize, err := askForSizeAndRegion(targetCloud)
-		must(err)
-		targetOptions["region"] = targetRegion
-		targetOptions["size"] = targetSize
-
-		targetBuildType, err := askForBuildType()
-		must(err)
-		targetOptions["build_type"] = targetBuildType
 	}
 
-	asyncId, err := startCreateStack(name, environment, serviceYaml, manifestYaml, targetOptions)
+	asyncId, err := startCreateStack(spec.Name, spec.Environment, serviceYaml, manifestYaml, targetOptionsFromSpec(spec))
 	must(err)
 
 	// now we fetch the corresponding stack
-	stack, err := client.StackInfoWithEnvironment(name, environment)
+	stack, err := client.StackInfoWithEnvironment(spec.Name, spec.Environment)
 	must(err)
 
 	// wait for the stack analysis to complete
@@ -80,12 +54,106 @@ func runCreateStack(c *cli.Context) {
 	must(err)
 	fmt.Printf("\nStack created; Build starting...\n\n")
 
+	must(applyStackSpecEnvVars(stack.Uid, spec.EnvVars))
+
 	err = initiateBuildStack(stack.Uid)
 	must(err)
 
 	stack, err = waitForBuild(stack)
 	must(err)
+	if stack == nil {
+		printFatal("Stack build did not return stack information")
+	}
 	fmt.Println("Stack build completed successfully!")
+
+	must(runStackSpecPostCreateHooks(stack.Uid, spec.PostCreate))
+}
+
+// applyStackSpecEnvVars sets every env var in envVars on the newly created
+// stack, before its first build, so post_create hooks and the build itself
+// see them already in place.
+func applyStackSpecEnvVars(stackUid string, envVars map[string]string) error {
+	for key, value := range envVars {
+		asyncId, err := startEnvVarSet(stackUid, key, value, false, "immediately")
+		if err != nil {
+			return fmt.Errorf("setting env var %s: %w", key, err)
+		}
+		if _, err := endEnvVarSet(*asyncId, stackUid); err != nil {
+			return fmt.Errorf("setting env var %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// runStackSpecPostCreateHooks runs each post_create hook in spec order.
+func runStackSpecPostCreateHooks(stackUid string, hooks []cxStackSpecHook) error {
+	for _, hook := range hooks {
+		switch hook.Command {
+		case "env-vars set":
+			asyncId, err := startEnvVarSet(stackUid, hook.Key, hook.Value, false, "immediately")
+			if err != nil {
+				return fmt.Errorf("post_create env-vars set %s: %w", hook.Key, err)
+			}
+			if _, err := endEnvVarSet(*asyncId, stackUid); err != nil {
+				return fmt.Errorf("post_create env-vars set %s: %w", hook.Key, err)
+			}
+		case "redeploy":
+			if err := initiateBuildStack(stackUid); err != nil {
+				return fmt.Errorf("post_create redeploy: %w", err)
+			}
+		default:
+			return fmt.Errorf("post_create: unknown command %q (expected \"env-vars set\" or \"redeploy\")", hook.Command)
+		}
+	}
+	return nil
+}
+
+// buildStackSpecInteractively prompts for everything a cx-stack.yaml would
+// otherwise supply, and normalizes the answers into the same struct a
+// --spec file parses into.
+func buildStackSpecInteractively(c *cli.Context, accountInfo cloud66.Account) (*cxStackSpec, error) {
+	name := c.String("name")
+	if len(name) < 5 {
+		return nil, errors.New("name is required and must be at least 5 characters long")
+	}
+	environment := c.String("environment")
+	if environment == "" {
+		return nil, errors.New("environment is required")
+	}
+	serviceYamlFile := c.String("service_yaml")
+	if serviceYamlFile == "" {
+		return nil, errors.New("service_yaml file path is required")
+	}
+
+	spec := &cxStackSpec{
+		Name:         name,
+		Environment:  environment,
+		ServiceYaml:  serviceYamlFile,
+		ManifestYaml: c.String("manifest_yaml"),
+	}
+
+	if spec.ManifestYaml == "" {
+		targetCloud, err := askForCloud(accountInfo)
+		if err != nil {
+			return nil, err
+		}
+		spec.Cloud = targetCloud
+
+		targetRegion, targetSize, err := askForSizeAndRegion(targetCloud)
+		if err != nil {
+			return nil, err
+		}
+		spec.Region = targetRegion
+		spec.Size = targetSize
+
+		targetBuildType, err := askForBuildType()
+		if err != nil {
+			return nil, err
+		}
+		spec.BuildType = targetBuildType
+	}
+
+	return spec, nil
 }
 
 func startCreateStack(name, environment, serviceYaml, manifestYaml string, targetOptions map[string]string) (*int, error) {
@@ -108,9 +176,8 @@ func initiateBuildStack(stackUid string) error {
 func waitForBuild(stack *cloud66.Stack) (*cloud66.Stack, error) {
 
 	// log output
-	StartListen(stack)
-	return nil, nil
-	// return client.WaitStackBuild(stackUid)
+	go StartListen(stack)
+	return WaitStackBuild(stack.Uid, false)
 }
 
 func askForCloud(accountInfo cloud66.Account) (string, error) {
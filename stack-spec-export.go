@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/cloud66/cli"
+	"gopkg.in/go-yaml/yaml.v2"
+)
+
+// this is an alias for stacks spec export command
+var cmdStackSpecExport = &Command{
+	Name:  "spec-export",
+	Run:   runStackSpecExport,
+	Build: buildBasicCommand,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "file",
+			Usage: "[OPTIONAL] write the spec to this file instead of stdout",
+		},
+	},
+
+	NeedsStack: true,
+	NeedsOrg:   false,
+	Short:      "An alias for 'stacks spec export' command",
+}
+
+// runStackSpecExport dumps an existing stack's configuration into the
+// cx-stack.yaml schema "stacks create --spec" consumes, so an interactively
+// created stack can be turned into a reproducible, version-controllable
+// spec after the fact. service_yaml and manifest_yaml aren't retrievable
+// from a running stack, so those two fields are left blank for the user to
+// fill in.
+func runStackSpecExport(c *cli.Context) {
+	stack := mustStack(c)
+
+	envVars, err := client.StackEnvVars(stack.Uid)
+	must(err)
+
+	spec := &cxStackSpec{
+		Name:        stack.Name,
+		Environment: stack.Environment,
+		EnvVars:     make(map[string]string, len(envVars)),
+	}
+	for _, envVar := range envVars {
+		if envVar.Readonly {
+			continue
+		}
+		spec.EnvVars[envVar.Key] = envVarStringValue(envVar)
+	}
+
+	if file := c.String("file"); file != "" {
+		must(writeStackSpec(file, spec))
+		fmt.Printf("Wrote %s\n", file)
+		return
+	}
+
+	data, err := yaml.Marshal(spec)
+	must(err)
+	fmt.Print(string(data))
+}
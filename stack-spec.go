@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/go-yaml/yaml.v2"
+)
+
+// cxStackSpecHook is one entry in a cx-stack.yaml's post_create list: a
+// command to run once the stack has finished its first build, in the style
+// of the command it names. Only "env-vars set" and "redeploy" are
+// supported for now - enough to seed variables and kick off a deploy
+// without reaching for a second cx invocation.
+type cxStackSpecHook struct {
+	Command string `yaml:"command"`
+	Key     string `yaml:"key,omitempty"`
+	Value   string `yaml:"value,omitempty"`
+}
+
+// cxStackSpec is the schema of a declarative cx-stack.yaml: everything
+// "stacks create" used to ask for interactively, captured as data so stack
+// creation is reproducible and diffable instead of a one-shot prompt
+// sequence. askForCloud/askForSizeAndRegion/askForBuildType build one of
+// these from terminal input; loadStackSpec builds one from a file; both
+// feed the same runCreateStack.
+type cxStackSpec struct {
+	Name         string            `yaml:"name"`
+	Environment  string            `yaml:"environment"`
+	ServiceYaml  string            `yaml:"service_yaml"`
+	ManifestYaml string            `yaml:"manifest_yaml,omitempty"`
+	Cloud        string            `yaml:"cloud,omitempty"`
+	Region       string            `yaml:"region,omitempty"`
+	Size         string            `yaml:"size,omitempty"`
+	BuildType    string            `yaml:"build_type,omitempty"`
+	EnvVars      map[string]string `yaml:"env_vars,omitempty"`
+	PostCreate   []cxStackSpecHook `yaml:"post_create,omitempty"`
+}
+
+// loadStackSpec reads and validates a cx-stack.yaml.
+func loadStackSpec(path string) (*cxStackSpec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec cxStackSpec
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	if len(spec.Name) < 5 {
+		return nil, fmt.Errorf("%s: name is required and must be at least 5 characters long", path)
+	}
+	if spec.Environment == "" {
+		return nil, fmt.Errorf("%s: environment is required", path)
+	}
+	if spec.ServiceYaml == "" {
+		return nil, fmt.Errorf("%s: service_yaml is required", path)
+	}
+
+	return &spec, nil
+}
+
+// writeStackSpec marshals spec as YAML to path.
+func writeStackSpec(path string, spec *cxStackSpec) error {
+	data, err := yaml.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// targetOptionsFromSpec adapts spec's cloud/region/size/build_type into the
+// map[string]string shape client.CreateStack expects.
+func targetOptionsFromSpec(spec *cxStackSpec) map[string]string {
+	targetOptions := make(map[string]string)
+	if spec.Cloud != "" {
+		targetOptions["cloud"] = spec.Cloud
+	}
+	if spec.Region != "" {
+		targetOptions["region"] = spec.Region
+	}
+	if spec.Size != "" {
+		targetOptions["size"] = spec.Size
+	}
+	if spec.BuildType != "" {
+		targetOptions["build_type"] = spec.BuildType
+	}
+	return targetOptions
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/cloud66/cli"
@@ -38,6 +39,22 @@ var cmdRedeploy = &Command{
 			Name:  "deployment-profile",
 			Usage: "use a named deployment profile that you have configured on your stack",
 		},
+		cli.BoolFlag{
+			Name:  "detect-drift",
+			Usage: "[OPTIONAL] compare the stack's live service/image/env-var state against deployment-profile (or --desired) before deploying",
+		},
+		cli.StringFlag{
+			Name:  "desired",
+			Usage: "[OPTIONAL] a manifest.yml describing the desired state, used instead of --deployment-profile with --detect-drift",
+		},
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "[OPTIONAL] deploy even if --detect-drift found drift",
+		},
+		cli.BoolFlag{
+			Name:  "watch",
+			Usage: "[OPTIONAL] stream newline-delimited JSON progress events instead of the human-readable --listen output",
+		},
 	},
 
 	NeedsStack: true,
@@ -86,9 +103,40 @@ func runRedeploy(c *cli.Context) {
 		printFatal("The \"service\" argument only applies to Maestro stacks")
 	}
 
+	if c.Bool("detect-drift") {
+		desired, err := loadDesiredDriftState(stack.Uid, deploymentProfile, c.String("desired"))
+		must(err)
+
+		live, err := fetchLiveDriftState(stack.Uid)
+		must(err)
+
+		findings := diffDriftStates(desired, live)
+		if len(findings) > 0 {
+			fmt.Println("Drift detected:")
+			for _, finding := range findings {
+				fmt.Println(finding.String())
+			}
+			if !c.Bool("force") {
+				printFatal("Refusing to deploy with drift present. Re-run with --force to deploy anyway")
+			}
+		} else {
+			fmt.Println("No drift detected")
+		}
+	}
+
 	result, err := client.RedeployStack(stack.Uid, gitRef, deployStrategy, deploymentProfile, services)
 	must(err)
 
+	watch := c.Bool("watch")
+
+	if watch && result.AsyncActionId != nil {
+		events := watchStackAsyncAction(*(result.AsyncActionId), stack.Uid, asyncPhaseDeploying, 3*time.Second, 120*time.Minute)
+		if printAsyncWatchEvents(events) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	if !c.Bool("listen") || result.Queued {
 		// its queued - just message and exit
 		fmt.Println(result.Message)
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cxIgnoreRule is a single gitignore-style line from a .cxignore file,
+// rooted at the directory the file was found in.
+type cxIgnoreRule struct {
+	dir     string // directory the rule applies under, relative to the matcher's root
+	pattern string
+	negate  bool
+}
+
+// cxIgnoreMatcher holds every .cxignore rule found under a stencil folder,
+// in load order so deeper, more specific files naturally override shallower
+// ones (the same way per-directory .gitignore files stack).
+type cxIgnoreMatcher struct {
+	root  string
+	rules []cxIgnoreRule
+}
+
+// loadCxIgnore walks root and compiles every .cxignore file it finds, in
+// addition to the implicit built-in rule that always ignores ".pause".
+func loadCxIgnore(root string) (*cxIgnoreMatcher, error) {
+	matcher := &cxIgnoreMatcher{
+		root:  root,
+		rules: []cxIgnoreRule{{dir: ".", pattern: ".pause"}},
+	}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Base(path) != ".cxignore" {
+			return nil
+		}
+
+		rules, err := parseCxIgnoreFile(root, path)
+		if err != nil {
+			return err
+		}
+		matcher.rules = append(matcher.rules, rules...)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return matcher, nil
+}
+
+func parseCxIgnoreFile(root string, path string) ([]cxIgnoreRule, error) {
+	relDir, err := filepath.Rel(root, filepath.Dir(path))
+	if err != nil {
+		relDir = "."
+	}
+	relDir = filepath.ToSlash(relDir)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []cxIgnoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		negate := false
+		if strings.HasPrefix(line, "!") {
+			negate = true
+			line = line[1:]
+		}
+
+		rules = append(rules, cxIgnoreRule{dir: relDir, pattern: line, negate: negate})
+	}
+
+	return rules, scanner.Err()
+}
+
+// isIgnored reports whether path (absolute, or relative to the matcher's
+// root) is excluded by the loaded .cxignore rules. Later rules win, and a
+// rule only applies to paths under the directory its .cxignore file lives
+// in, mirroring gitignore's per-directory stacking.
+func (m *cxIgnoreMatcher) isIgnored(path string) (bool, error) {
+	if m == nil {
+		return false, nil
+	}
+
+	rel, err := filepath.Rel(m.root, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+	rel = filepath.ToSlash(rel)
+
+	ignored := false
+	for _, rule := range m.rules {
+		testPath := rel
+		if rule.dir != "." {
+			prefix := rule.dir + "/"
+			if !strings.HasPrefix(rel, prefix) {
+				continue
+			}
+			testPath = strings.TrimPrefix(rel, prefix)
+		}
+
+		matched, err := globMatch(rule.pattern, testPath)
+		if err != nil {
+			return false, err
+		}
+		if !matched && !strings.Contains(rule.pattern, "/") {
+			// a pattern with no slash matches at any depth under its directory
+			matched, err = globMatch(rule.pattern, filepath.Base(testPath))
+			if err != nil {
+				return false, err
+			}
+		}
+
+		if matched {
+			ignored = !rule.negate
+		}
+	}
+
+	return ignored, nil
+}
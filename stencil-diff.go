@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// unifiedStencilDiff renders a unified diff between a stencil as rendered
+// against fromSnapshotUID (a) and toSnapshotUID (b), for use by the
+// `render --diff` flag.
+func unifiedStencilDiff(stencilFilename string, fromSnapshotUID string, toSnapshotUID string, a []byte, b []byte, contextLines int) (string, error) {
+	diff := difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(a)),
+		B:        difflib.SplitLines(string(b)),
+		FromFile: fmt.Sprintf("%s @ %s", stencilFilename, fromSnapshotUID),
+		ToFile:   fmt.Sprintf("%s @ %s", stencilFilename, toSnapshotUID),
+		Context:  contextLines,
+	}
+
+	return difflib.GetUnifiedDiffString(diff)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// stencilIncluded reports whether path should be selected given a set of
+// include and exclude glob patterns: a path matches when it matches any
+// include pattern (or no includes are given) and matches no exclude pattern.
+func stencilIncluded(includes []string, excludes []string, path string) (bool, error) {
+	if len(includes) > 0 {
+		matched, err := matchesAnyPattern(includes, path)
+		if err != nil {
+			return false, err
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+
+	excluded, err := matchesAnyPattern(excludes, path)
+	if err != nil {
+		return false, err
+	}
+
+	return !excluded, nil
+}
+
+// matchesAnyPattern reports whether path matches any of the given shell-glob
+// patterns. This mirrors restic's filter.List: each pattern is tested
+// against both path and its basename, and "**" matches zero or more path
+// components in addition to the usual filepath.Match wildcards.
+func matchesAnyPattern(patterns []string, path string) (bool, error) {
+	for _, pattern := range patterns {
+		matched, err := globMatchPath(pattern, path)
+		if err != nil {
+			return false, err
+		}
+		if matched {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// globMatchPath reports whether pattern matches path or path's basename.
+func globMatchPath(pattern string, path string) (bool, error) {
+	if matched, err := globMatch(pattern, path); err != nil {
+		return false, err
+	} else if matched {
+		return true, nil
+	}
+
+	return globMatch(pattern, filepath.Base(path))
+}
+
+// globMatch reports whether pattern matches name, where "**" in pattern
+// matches zero or more path components. Patterns without "**" fall back to
+// filepath.Match.
+func globMatch(pattern string, name string) (bool, error) {
+	if !strings.Contains(pattern, "**") {
+		return filepath.Match(pattern, name)
+	}
+
+	return globMatchSegments(splitPathSegments(pattern), splitPathSegments(name))
+}
+
+func splitPathSegments(path string) []string {
+	return strings.Split(filepath.ToSlash(path), "/")
+}
+
+// globMatchSegments matches pattern components against path components,
+// where a "**" component consumes zero or more path components.
+func globMatchSegments(pattern []string, path []string) (bool, error) {
+	if len(pattern) == 0 {
+		return len(path) == 0, nil
+	}
+
+	if pattern[0] == "**" {
+		if matched, err := globMatchSegments(pattern[1:], path); err != nil || matched {
+			return matched, err
+		}
+		if len(path) == 0 {
+			return false, nil
+		}
+		return globMatchSegments(pattern, path[1:])
+	}
+
+	if len(path) == 0 {
+		return false, nil
+	}
+
+	matched, err := filepath.Match(pattern[0], path[0])
+	if err != nil {
+		return false, err
+	}
+	if !matched {
+		return false, nil
+	}
+
+	return globMatchSegments(pattern[1:], path[1:])
+}
+
+// splitCSVList parses a comma separated list of values, as used by the
+// --include, --exclude and --post flags.
+func splitCSVList(value string) []string {
+	if value == "" {
+		return nil
+	}
+
+	return strings.Split(value, ",")
+}
+
+// stencilRelPath returns path relative to root for filter matching,
+// falling back to the basename if root is unset or the path isn't under it.
+func stencilRelPath(root string, path string) string {
+	if root == "" {
+		return filepath.Base(path)
+	}
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return filepath.Base(path)
+	}
+
+	return rel
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/cloud66-oss/cloud66"
+)
+
+// printStencilsJSON prints a formation's stencils (already sorted) as a
+// JSON array, for `stencils list --output json`.
+func printStencilsJSON(stencils []cloud66.Stencil) {
+	data, err := json.MarshalIndent(stencils, "", "  ")
+	if err != nil {
+		printFatal("Failed to marshal stencils as JSON: %s", err.Error())
+	}
+
+	fmt.Println(string(data))
+}
+
+// printStencilJSON prints a single stencil as JSON, for `stencils show --json`.
+func printStencilJSON(stencil cloud66.Stencil) {
+	data, err := json.MarshalIndent(stencil, "", "  ")
+	if err != nil {
+		printFatal("Failed to marshal stencil as JSON: %s", err.Error())
+	}
+
+	fmt.Println(string(data))
+}
+
+// stencilRenderJSON is the machine-readable result of rendering a single
+// stencil, emitted one-per-line by `stencils render --json` so callers can
+// pipe through jq and script CI gates. Warnings and errors are always
+// present, even when empty.
+type stencilRenderJSON struct {
+	Source     string   `json:"source"`
+	OutputPath string   `json:"output_path"`
+	Checksum   string   `json:"checksum"`
+	Warnings   []string `json:"warnings"`
+	Errors     []string `json:"errors"`
+	Content    string   `json:"content"`
+}
+
+func printRenderResultJSON(result stencilRenderJSON) {
+	if result.Warnings == nil {
+		result.Warnings = []string{}
+	}
+	if result.Errors == nil {
+		result.Errors = []string{}
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to marshal render result as JSON: %s\n", err.Error())
+		return
+	}
+
+	fmt.Println(string(data))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"gopkg.in/go-yaml/yaml.v2"
+)
+
+// builtinPostProcessors maps a short post-processor name to the command
+// used to run it. Each command reads the rendered stencil on stdin and is
+// expected to write the transformed content to stdout.
+var builtinPostProcessors = map[string][]string{
+	"kubeval":     {"kubeval", "-"},
+	"kubeconform": {"kubeconform", "-"},
+	"yamllint":    {"yamllint", "-"},
+	"sops":        {"sops", "-e", "/dev/stdin"},
+	"kustomize":   {"kustomize", "build", "-"},
+}
+
+// cxConfig is the subset of .cx.yml this tool understands.
+type cxConfig struct {
+	PostProcessors []string `yaml:"post_processors"`
+}
+
+// loadCxConfig reads post-processor configuration from .cx.yml in the
+// current directory. A missing file is not an error: it just means no
+// config-driven post-processors are configured.
+func loadCxConfig() (*cxConfig, error) {
+	data, err := ioutil.ReadFile(".cx.yml")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &cxConfig{}, nil
+		}
+		return nil, err
+	}
+
+	var cfg cxConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// resolvePostProcessorCommand turns a post-processor name into the command
+// and arguments to run. "exec:<cmd>" runs an arbitrary shell command; any
+// other name must be one of the built-ins.
+func resolvePostProcessorCommand(name string) ([]string, error) {
+	if strings.HasPrefix(name, "exec:") {
+		fields := strings.Fields(strings.TrimPrefix(name, "exec:"))
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("empty exec: post-processor command")
+		}
+		return fields, nil
+	}
+
+	if command, ok := builtinPostProcessors[name]; ok {
+		return command, nil
+	}
+
+	return nil, fmt.Errorf("unknown post-processor '%s'", name)
+}
+
+// runPostProcessor pipes input through the named post-processor and
+// returns its stdout. A non-zero exit is reported as an error.
+func runPostProcessor(name string, input []byte) ([]byte, error) {
+	command, err := resolvePostProcessorCommand(name)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = err.Error()
+		}
+		return nil, fmt.Errorf("post-processor '%s' failed: %s", name, message)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// applyPostProcessors runs each post-processor in order, feeding the
+// output of one into the next.
+func applyPostProcessors(processors []string, content []byte) ([]byte, error) {
+	for _, name := range processors {
+		processed, err := runPostProcessor(name, content)
+		if err != nil {
+			return content, err
+		}
+		content = processed
+	}
+
+	return content, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/cloud66/cli"
+	"gopkg.in/go-yaml/yaml.v2"
+)
+
+// templateRepoManifestFilename is the metadata file a stencil template
+// repository commits at its root, describing every stencil it ships. This
+// is the same shape the server stores per-stencil as cloud66.StencilTemplate,
+// just round-tripped through YAML so template authors can lint it locally
+// before pushing.
+const templateRepoManifestFilename = "stencils.yml"
+
+// templateRepoStencilMeta is one entry in stencils.yml.
+type templateRepoStencilMeta struct {
+	Filename          string   `yaml:"filename"`
+	Name              string   `yaml:"name"`
+	FilenamePattern   string   `yaml:"filename_pattern"`
+	Description       string   `yaml:"description,omitempty"`
+	ContextType       string   `yaml:"context_type"`
+	Tags              []string `yaml:"tags,omitempty"`
+	PreferredSequence int      `yaml:"preferred_sequence"`
+}
+
+type templateRepoManifest struct {
+	Stencils []templateRepoStencilMeta `yaml:"stencils"`
+}
+
+// templateRepoContextTypes are the context types a stencil can declare.
+// "service" stencils are rendered once per service in the stack; "global"
+// stencils are rendered once per stack regardless of service count.
+var templateRepoContextTypes = map[string]bool{
+	"service": true,
+	"global":  true,
+}
+
+// loadTemplateRepoManifest reads repoPath/stencils.yml.
+func loadTemplateRepoManifest(repoPath string) (*templateRepoManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(repoPath, templateRepoManifestFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest templateRepoManifest
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// templateRepoLintIssue is one problem found with a stencil's metadata.
+type templateRepoLintIssue struct {
+	Filename string
+	Message  string
+}
+
+// lintTemplateRepoManifest validates every entry in manifest, returning one
+// issue per problem found. A stencil can accumulate more than one issue.
+func lintTemplateRepoManifest(manifest *templateRepoManifest) []templateRepoLintIssue {
+	var issues []templateRepoLintIssue
+	sequences := make(map[int][]string)
+
+	for _, stencil := range manifest.Stencils {
+		name := stencil.Filename
+		if name == "" {
+			name = stencil.Name
+		}
+
+		if stencil.FilenamePattern == "" {
+			issues = append(issues, templateRepoLintIssue{name, "filename_pattern is required"})
+		} else if _, err := filepath.Match(stencil.FilenamePattern, stencil.Filename); err != nil {
+			issues = append(issues, templateRepoLintIssue{name, fmt.Sprintf("filename_pattern %q is not a valid glob: %s", stencil.FilenamePattern, err.Error())})
+		}
+
+		if !templateRepoContextTypes[stencil.ContextType] {
+			issues = append(issues, templateRepoLintIssue{name, fmt.Sprintf("context_type %q must be one of service, global", stencil.ContextType)})
+		}
+
+		if len(stencil.Tags) == 0 {
+			issues = append(issues, templateRepoLintIssue{name, "at least one tag is required"})
+		}
+
+		if stencil.PreferredSequence <= 0 {
+			issues = append(issues, templateRepoLintIssue{name, "preferred_sequence must be a positive integer"})
+		} else {
+			sequences[stencil.PreferredSequence] = append(sequences[stencil.PreferredSequence], name)
+		}
+	}
+
+	for sequence, names := range sequences {
+		if len(names) > 1 {
+			for _, name := range names {
+				issues = append(issues, templateRepoLintIssue{name, fmt.Sprintf("preferred_sequence %d is also used by %v", sequence, names)})
+			}
+		}
+	}
+
+	sort.Slice(issues, func(i, j int) bool {
+		if issues[i].Filename != issues[j].Filename {
+			return issues[i].Filename < issues[j].Filename
+		}
+		return issues[i].Message < issues[j].Message
+	})
+
+	return issues
+}
+
+// runTemplatesLint validates a stencil template repository's stencils.yml
+// without needing a stack, org, or network round-trip, so template authors
+// can catch metadata mistakes before "templates resync" picks them up.
+func runTemplatesLint(c *cli.Context) {
+	repoPath := c.String("path")
+	if repoPath == "" {
+		printFatal("No repository path provided. Please use --path to specify a local checkout of the template repository")
+	}
+
+	manifest, err := loadTemplateRepoManifest(repoPath)
+	must(err)
+
+	issues := lintTemplateRepoManifest(manifest)
+	if len(issues) == 0 {
+		fmt.Println("No issues found")
+		return
+	}
+
+	for _, issue := range issues {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", issue.Filename, issue.Message)
+	}
+	fmt.Fprintf(os.Stderr, "%d issue(s) found\n", len(issues))
+	os.Exit(1)
+}
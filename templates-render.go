@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/cloud66/cli"
+	"gopkg.in/go-yaml/yaml.v2"
+)
+
+// templateRepoRenderDiagnostic is one problem found while rendering a
+// single stencil locally, surfaced the same way renders.Errors()/
+// renders.Warnings() are surfaced for a server-side render.
+type templateRepoRenderDiagnostic struct {
+	Filename string
+	Message  string
+}
+
+// loadTemplateRepoContext builds the data a stencil's template is rendered
+// against. contextArg is either the UID of a real stack (context comes from
+// the API, same as a server-side render) or the path to a local YAML file
+// standing in for one, so a template author can iterate without a stack at
+// all.
+func loadTemplateRepoContext(contextArg string) (map[string]interface{}, error) {
+	if data, err := ioutil.ReadFile(contextArg); err == nil {
+		var context map[string]interface{}
+		if err := yaml.Unmarshal(data, &context); err != nil {
+			return nil, fmt.Errorf("parsing context file %s: %w", contextArg, err)
+		}
+		return context, nil
+	}
+
+	stack, err := client.StackInfo(contextArg)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither a readable context file nor a known stack UID: %w", contextArg, err)
+	}
+
+	return map[string]interface{}{
+		"StackName":   stack.Name,
+		"Environment": stack.Environment,
+		"Framework":   stack.Framework,
+	}, nil
+}
+
+// templateRepoUndefinedVarPattern finds a bare "{{ .Name }}"/"{{.Name}}"
+// field reference so it can be checked against the context before render,
+// since Go's text/template only reports a missing field at execute time -
+// wrapped in whatever error text the template happens to produce.
+var templateRepoUndefinedVarPattern = regexp.MustCompile(`\{\{\s*\.([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// templateRepoIncludePattern finds a "{{ template "name" }}" or
+// "{{ include "name" }}" reference to another stencil.
+var templateRepoIncludePattern = regexp.MustCompile(`\{\{\s*(?:template|include)\s+"([^"]+)"`)
+
+// checkTemplateRepoReferences reports undefined {{ .Var }} references and
+// includes that don't resolve to another file in the same repo.
+func checkTemplateRepoReferences(source string, context map[string]interface{}, knownFiles map[string]bool) []string {
+	var problems []string
+
+	for _, match := range templateRepoUndefinedVarPattern.FindAllStringSubmatch(source, -1) {
+		if _, ok := context[match[1]]; !ok {
+			problems = append(problems, fmt.Sprintf("unknown variable %q", match[1]))
+		}
+	}
+
+	for _, match := range templateRepoIncludePattern.FindAllStringSubmatch(source, -1) {
+		if !knownFiles[match[1]] {
+			problems = append(problems, fmt.Sprintf("unresolved include %q", match[1]))
+		}
+	}
+
+	return problems
+}
+
+// renderTemplateRepoStencil renders a single stencil file's Go text/template
+// source against context.
+func renderTemplateRepoStencil(path string, context map[string]interface{}) (string, error) {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	tpl, err := template.New(filepath.Base(path)).Parse(string(source))
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	if err := tpl.Execute(&out, context); err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
+
+// runTemplatesRender renders every stencil in a local template repository
+// checkout against either a real stack's context or a fake context YAML,
+// using the same Go text/template engine the server uses to render a
+// stencil body. It's a fast local loop for template authors: full context
+// semantics (services, snapshots) still only exist server-side, so this is
+// a lint-grade approximation, not a guarantee the server will render
+// identically.
+func runTemplatesRender(c *cli.Context) {
+	repoPath := c.String("path")
+	if repoPath == "" {
+		printFatal("No repository path provided. Please use --path to specify a local checkout of the template repository")
+	}
+
+	contextArg := c.String("context")
+	if contextArg == "" {
+		printFatal("No context provided. Please use --context to specify a stack UID or a context YAML file")
+	}
+
+	outputDir := c.String("output")
+	if outputDir == "" {
+		printFatal("No output folder provided. Please use --output to specify where rendered stencils are written")
+	}
+
+	context, err := loadTemplateRepoContext(contextArg)
+	must(err)
+
+	files, err := ioutil.ReadDir(repoPath)
+	must(err)
+
+	knownFiles := make(map[string]bool, len(files))
+	for _, file := range files {
+		if !file.IsDir() && !strings.HasPrefix(file.Name(), "_") {
+			knownFiles[file.Name()] = true
+		}
+	}
+
+	if manifest, err := loadTemplateRepoManifest(repoPath); err == nil {
+		for _, issue := range lintTemplateRepoManifest(manifest) {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", issue.Filename, issue.Message)
+		}
+	}
+
+	must(os.MkdirAll(outputDir, os.ModePerm))
+
+	var names []string
+	for _, file := range files {
+		if knownFiles[file.Name()] {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+
+	failed := false
+	for _, name := range names {
+		path := filepath.Join(repoPath, name)
+		source, err := ioutil.ReadFile(path)
+		must(err)
+
+		for _, problem := range checkTemplateRepoReferences(string(source), context, knownFiles) {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, problem)
+			failed = true
+		}
+
+		rendered, err := renderTemplateRepoStencil(path, context)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err.Error())
+			failed = true
+			continue
+		}
+
+		outPath := filepath.Join(outputDir, name)
+		must(ioutil.WriteFile(outPath, []byte(rendered), 0644))
+		fmt.Printf("Rendered %s -> %s\n", name, outPath)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -60,6 +60,53 @@ Second Awesome Repository     second-awesome-repo 		bt-e2e869ee6ce97ee58a17aa264
 
 Examples:
 $ cx templates resync --template='bt-2e0810a17c33ab35d7970ff330b1f916'
+`,
+		},
+		cli.Command{
+			Name:   "render",
+			Usage:  "renders a local template repository checkout for fast local iteration",
+			Action: runTemplatesRender,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "path",
+					Usage: "local checkout of the stencil template repository",
+				},
+				cli.StringFlag{
+					Name:  "context",
+					Usage: "a stack UID, or the path to a context YAML standing in for one",
+				},
+				cli.StringFlag{
+					Name:  "output",
+					Usage: "folder to write rendered stencils to",
+				},
+			},
+			Description: `Renders every stencil in a local template repository checkout, using the same
+Go text/template engine the server renders a stencil body with, and reports per-file
+diagnostics: unknown variables, unresolved includes, and stencils.yml metadata issues.
+This gives template authors a fast local loop instead of round-tripping through
+"templates resync".
+
+Examples:
+$ cx templates render --path=./my-stencils --context=st-1234567890abcdef --output=./rendered
+$ cx templates render --path=./my-stencils --context=./fake-context.yml --output=./rendered
+`,
+		},
+		cli.Command{
+			Name:   "lint",
+			Usage:  "validates a local template repository's stencils.yml metadata",
+			Action: runTemplatesLint,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "path",
+					Usage: "local checkout of the stencil template repository",
+				},
+			},
+			Description: `Validates FilenamePattern, ContextType, Tags and PreferredSequence across every
+stencil declared in a repository's stencils.yml, and exits non-zero if any issues
+are found. Intended to run in CI before a template repository is pushed.
+
+Examples:
+$ cx templates lint --path=./my-stencils
 `,
 		},
 	}